@@ -0,0 +1,311 @@
+package bingo
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the archive format.
+const archiveVersion = 1
+
+// Name of the manifest entry, first entry of an archive.
+const archiveManifest = "manifest.json"
+
+// Folder of the paste entries in an archive.
+const archivePastes = "pastes"
+
+/*
+Archive manifest.
+
+ - Version: archive format version
+ - Date: export date
+*/
+type archiveManifestData struct {
+	Version int       `json:"version"`
+	Date    time.Time `json:"date"`
+}
+
+/*
+Report of an archive export or import.
+
+ - Pastes: number of exported or imported pastes
+ - Comments: number of exported or imported comments
+ - Revisions: number of exported or imported previous revisions of pastes
+ - Attachments: number of exported or imported attachments
+ - Expired: number of expired pastes skipped on import
+ - Conflicts: ids of the pastes not imported because their id is in use
+*/
+type ArchiveReport struct {
+	Pastes      int
+	Comments    int
+	Revisions   int
+	Attachments int
+	Expired     int
+	Conflicts   []string
+}
+
+// Export writes every paste of the store and its discussion to a tar archive,
+// compressed with gzip if compress is set.
+func Export(file string, w io.Writer, compress bool) (ArchiveReport, error) {
+	if err := setup(file); err != nil {
+		return ArchiveReport{}, err
+	}
+	s, err := openStore()
+	if err != nil {
+		return ArchiveReport{}, err
+	}
+	store = s
+
+	if compress {
+		gz := gzip.NewWriter(w)
+		report, err := exportArchive(gz)
+		if err != nil {
+			return report, err
+		}
+		return report, gz.Close()
+	}
+	return exportArchive(w)
+}
+
+// Import loads the pastes of a tar archive, compressed with gzip or not,
+// into the store. Expired pastes are skipped and pastes whose id is already
+// in use are reported as conflicts.
+func Import(file string, r io.Reader) (ArchiveReport, error) {
+	if err := setup(file); err != nil {
+		return ArchiveReport{}, err
+	}
+	s, err := openStore()
+	if err != nil {
+		return ArchiveReport{}, err
+	}
+	store = s
+
+	// The index is needed to enforce the quota
+	if err := buildIndex(); err != nil {
+		return ArchiveReport{}, err
+	}
+
+	return importArchive(r)
+}
+
+// Add a json entry to an archive.
+func writeArchiveEntry(tw *tar.Writer, name string, v interface{}, date time.Time) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0640,
+		Size:    int64(len(data)),
+		ModTime: date,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Write the pastes of the global store to a tar archive.
+// Each paste entry is followed by the entries of its comments, revisions and
+// attachments.
+func exportArchive(w io.Writer) (ArchiveReport, error) {
+	var report ArchiveReport
+	tw := tar.NewWriter(w)
+
+	now := time.Now()
+	if err := writeArchiveEntry(tw, archiveManifest, archiveManifestData{archiveVersion, now}, now); err != nil {
+		return report, err
+	}
+
+	err := store.Walk(func(paste *Paste) error {
+		if !paste.Trashed.IsZero() {
+			// Deleted, only kept until purged
+			return nil
+		}
+
+		comments, err := store.ListComments(paste)
+		if err != nil {
+			return fmt.Errorf("cannot load comments of paste %s: %s", paste.Id, err)
+		}
+
+		revisions, err := store.ListRevisions(paste)
+		if err != nil {
+			return fmt.Errorf("cannot load revisions of paste %s: %s", paste.Id, err)
+		}
+
+		paste.Comments = nil
+		if err := writeArchiveEntry(tw, path.Join(archivePastes, paste.Id+".json"), paste, paste.Postdate); err != nil {
+			return err
+		}
+		report.Pastes++
+
+		for _, comment := range comments {
+			name := path.Join(archivePastes, discussionKey(paste.Id), comment.Id+".json")
+			if err := writeArchiveEntry(tw, name, comment, comment.Postdate); err != nil {
+				return err
+			}
+			report.Comments++
+		}
+
+		for _, rev := range revisions {
+			name := path.Join(archivePastes, revisionsKey(paste.Id), strconv.Itoa(rev.Revision)+".json")
+			if err := writeArchiveEntry(tw, name, rev, rev.Postdate); err != nil {
+				return err
+			}
+			report.Revisions++
+		}
+
+		for _, a := range paste.Attachments {
+			attachment, err := store.GetAttachment(paste, a.Id)
+			if err != nil {
+				return fmt.Errorf("cannot load attachment %s of paste %s: %s", a.Id, paste.Id, err)
+			}
+			name := path.Join(archivePastes, attachmentsKey(paste.Id), a.Id+".json")
+			if err := writeArchiveEntry(tw, name, attachment, paste.Postdate); err != nil {
+				return err
+			}
+			report.Attachments++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	Loggers.Info.Printf("Exported %d pastes and %d comments", report.Pastes, report.Comments)
+	return report, tw.Close()
+}
+
+// Load the pastes of a tar archive into the global store.
+func importArchive(r io.Reader) (ArchiveReport, error) {
+	var report ArchiveReport
+
+	// Detect gzip compression
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return report, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	// Pastes imported so far, comments of other pastes are skipped
+	imported := make(map[string]*Paste)
+
+	tr := tar.NewReader(r)
+	for first := true; ; first = false {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return report, err
+		}
+
+		if first {
+			var manifest archiveManifestData
+			if header.Name != archiveManifest || json.Unmarshal(data, &manifest) != nil {
+				return report, fmt.Errorf("not a bingo archive")
+			}
+			if manifest.Version > archiveVersion {
+				return report, fmt.Errorf("unsupported archive version %d", manifest.Version)
+			}
+			continue
+		}
+
+		dir, name := path.Split(strings.TrimSuffix(header.Name, ".json"))
+		dir = strings.TrimSuffix(dir, "/")
+
+		if dir == archivePastes {
+			// Paste entry
+			paste := Paste{}
+			if err := json.Unmarshal(data, &paste); err != nil || paste.Id != name || !regexName.MatchString(name) {
+				return report, fmt.Errorf("invalid paste entry %s", header.Name)
+			}
+			if paste.hasExpired() {
+				report.Expired++
+				continue
+			}
+			if err := savePaste(&paste); err == ErrExists {
+				Loggers.Warn.Printf("Paste %s already exists, skip", paste.Id)
+				report.Conflicts = append(report.Conflicts, paste.Id)
+				continue
+			} else if err != nil {
+				return report, fmt.Errorf("cannot import paste %s: %s", paste.Id, err)
+			}
+			imported[paste.Id] = &paste
+			report.Pastes++
+		} else if parent := path.Dir(dir); parent == archivePastes && strings.HasSuffix(dir, "_") {
+			// Comment entry
+			paste, ok := imported[strings.TrimSuffix(path.Base(dir), "_")]
+			if !ok {
+				continue
+			}
+			comment := Comment{}
+			if err := json.Unmarshal(data, &comment); err != nil || comment.Id != name || !regexName.MatchString(name) {
+				return report, fmt.Errorf("invalid comment entry %s", header.Name)
+			}
+			if err := saveComment(paste, &comment); err != nil {
+				return report, fmt.Errorf("cannot import comment %s of paste %s: %s", comment.Id, paste.Id, err)
+			}
+			report.Comments++
+		} else if path.Dir(dir) == archivePastes && strings.HasSuffix(dir, "~") {
+			// Revision entry
+			paste, ok := imported[strings.TrimSuffix(path.Base(dir), "~")]
+			if !ok {
+				continue
+			}
+			rev := Revision{}
+			if err := json.Unmarshal(data, &rev); err != nil || strconv.Itoa(rev.Revision) != name || rev.Revision >= paste.Revision {
+				return report, fmt.Errorf("invalid revision entry %s", header.Name)
+			}
+			if err := saveRevision(paste, &rev); err != nil {
+				return report, fmt.Errorf("cannot import revision %d of paste %s: %s", rev.Revision, paste.Id, err)
+			}
+			report.Revisions++
+		} else if path.Dir(dir) == archivePastes && strings.HasSuffix(dir, "-") {
+			// Attachment entry
+			paste, ok := imported[strings.TrimSuffix(path.Base(dir), "-")]
+			if !ok {
+				continue
+			}
+			attachment := Attachment{}
+			if err := json.Unmarshal(data, &attachment); err != nil || attachment.Id != name {
+				return report, fmt.Errorf("invalid attachment entry %s", header.Name)
+			}
+			if _, ok := paste.attachment(name); !ok {
+				return report, fmt.Errorf("unknown attachment entry %s", header.Name)
+			}
+			// The paste size accounts for its attachments already
+			if err := store.PutAttachment(paste, &attachment); err != nil {
+				return report, fmt.Errorf("cannot import attachment %s of paste %s: %s", attachment.Id, paste.Id, err)
+			}
+			report.Attachments++
+		} else {
+			Loggers.Warn.Printf("Unknown archive entry %s, skip", header.Name)
+		}
+	}
+
+	Loggers.Info.Printf("Imported %d pastes and %d comments", report.Pastes, report.Comments)
+	return report, nil
+}
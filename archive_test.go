@@ -0,0 +1,97 @@
+package bingo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	setupTestStore()
+
+	paste := newPaste("Awesome paste")
+	paste.Discussion = true
+	paste.Expire = time.Now().Add(time.Hour)
+	paste.Revision = 1
+	expired := newPaste("1337")
+	expired.Expire = time.Now().Add(-time.Hour)
+	for _, p := range []*Paste{&paste, &expired} {
+		if err := store.CreatePaste(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comment := newComment("Comment", nil)
+	if err := store.AppendComment(&paste, &comment); err != nil {
+		t.Fatal(err)
+	}
+	attachment := newAttachment("Name", "File")
+	paste.Attachments = []Attachment{{Id: attachment.Id, Name: attachment.Name, Size: attachment.Size}}
+	if err := store.PutPaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutAttachment(&paste, &attachment); err != nil {
+		t.Fatal(err)
+	}
+	rev := Revision{Revision: 0, Data: "Original paste", Postdate: paste.Postdate}
+	if err := store.AddRevision(&paste, &rev); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		var err error
+		var report ArchiveReport
+		if compress {
+			gz := gzip.NewWriter(&buf)
+			report, err = exportArchive(gz)
+			gz.Close()
+		} else {
+			report, err = exportArchive(&buf)
+		}
+		if err != nil {
+			t.Fatalf("exportArchive() error: %s", err)
+		}
+		if report.Pastes != 2 || report.Comments != 1 || report.Revisions != 1 || report.Attachments != 1 {
+			t.Errorf("exportArchive() == %+v, want 2 pastes, 1 comment, 1 revision and 1 attachment", report)
+		}
+		archive := buf.Bytes()
+
+		// Import into an empty store
+		exported := store
+		setupTestStore()
+		report, err = importArchive(bytes.NewReader(archive))
+		if err != nil {
+			t.Fatalf("importArchive() error: %s", err)
+		}
+		if report.Pastes != 1 || report.Comments != 1 || report.Revisions != 1 || report.Expired != 1 || len(report.Conflicts) != 0 {
+			t.Errorf("importArchive() == %+v, want 1 paste, 1 comment, 1 revision and 1 expired paste", report)
+		}
+		if p, err := store.GetPaste(paste.Id); err != nil || p.Data != paste.Data {
+			t.Errorf("imported paste %s == %+v, %v", paste.Id, p, err)
+		}
+		if c, err := store.GetComment(&paste, comment.Id); err != nil || c.Data != comment.Data {
+			t.Errorf("imported comment %s == %+v, %v", comment.Id, c, err)
+		}
+		if a, err := store.GetAttachment(&paste, attachment.Id); err != nil || a.Data != attachment.Data || report.Attachments != 1 {
+			t.Errorf("imported attachment %s == %+v, %v", attachment.Id, a, err)
+		}
+		if r, err := store.GetRevision(&paste, 0); err != nil || r.Data != rev.Data {
+			t.Errorf("imported revision 0 of %s == %+v, %v", paste.Id, r, err)
+		}
+		if _, ok := index.ids[paste.Id]; !ok || len(index.h) != 1 {
+			t.Errorf("index after import == %v, want paste %s", index.ids, paste.Id)
+		}
+
+		// Importing again gives conflicts
+		report, err = importArchive(bytes.NewReader(archive))
+		if err != nil {
+			t.Fatalf("importArchive() error: %s", err)
+		}
+		if len(report.Conflicts) != 1 || report.Conflicts[0] != paste.Id || report.Comments != 0 {
+			t.Errorf("importArchive() twice == %+v, want a conflict on %s", report, paste.Id)
+		}
+
+		store = exported
+	}
+}
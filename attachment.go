@@ -0,0 +1,98 @@
+package bingo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Maximum size of an attachment (encrypted) name.
+const maxAttachmentNameSize = 1 << 10
+
+/*
+A file attached to a paste.
+
+Attachment data is encrypted by the client, as paste data. Pastes only store
+attachment metadata, attachment data being stored in separate records.
+
+ - Id: attachment id
+ - Name: file name (encrypted)
+ - Size: size of the (encrypted) data
+ - Data: file (encrypted) data, when uploading or downloading the attachment
+*/
+type Attachment struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Data string `json:"data,omitempty"`
+}
+
+// Create a new attachment with a random id.
+func newAttachment(name, data string) Attachment {
+	return Attachment{
+		Id:   newId(),
+		Name: name,
+		Size: int64(len(data)),
+		Data: data,
+	}
+}
+
+// Key of the attachments of a paste.
+func attachmentsKey(id string) string {
+	return id + "-"
+}
+
+// Key of an attachment.
+func attachmentKey(pasteId, id string) string {
+	return attachmentsKey(pasteId) + "/" + id
+}
+
+// Find the metadata of an attachment in a paste.
+func (paste *Paste) attachment(id string) (Attachment, bool) {
+	for _, a := range paste.Attachments {
+		if a.Id == id {
+			return a, true
+		}
+	}
+	return Attachment{}, false
+}
+
+// Save the data of the attachments of a new paste.
+// Attachments without data are skipped: imported pastes get their
+// attachments from the archive afterwards, and posts cannot hold them.
+func saveAttachments(paste *Paste) error {
+	for i := range paste.Attachments {
+		if paste.Attachments[i].Data == "" {
+			continue
+		}
+		if err := store.PutAttachment(paste, &paste.Attachments[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serialize attachment data as a record: a json header describing the blob
+// encoding, a newline and the blob.
+func encodeAttachment(data string) ([]byte, error) {
+	encoding, blob := encodeBlob(data)
+	header, err := json.Marshal(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(header, '\n'), blob...), nil
+}
+
+// Read attachment data from a record.
+func decodeAttachment(record []byte) (string, error) {
+	i := bytes.IndexByte(record, '\n')
+	if i < 0 {
+		return "", errors.New("invalid attachment record")
+	}
+	var encoding blobEncoding
+	if err := json.Unmarshal(record[:i], &encoding); err != nil {
+		return "", fmt.Errorf("invalid attachment record: %s", err)
+	}
+	return encoding.decodeBlob(record[i+1:])
+}
@@ -0,0 +1,91 @@
+package bingo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachmentRecord(t *testing.T) {
+	for _, data := range []string{
+		base64.StdEncoding.EncodeToString([]byte("Awesome file")),
+		`{"iv":"AAAA","ct":"` + base64.StdEncoding.EncodeToString([]byte{0, 0xff}) + `"}`,
+		"line\nbreak",
+		"",
+	} {
+		record, err := encodeAttachment(data)
+		if err != nil {
+			t.Fatalf("encodeAttachment(%q) error: %s", data, err)
+		}
+		if decoded, err := decodeAttachment(record); err != nil || decoded != data {
+			t.Errorf("decodeAttachment(encodeAttachment(%q)) == %q, %v", data, decoded, err)
+		}
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	initPatterns()
+
+	conf.MaxAttachments = 2
+	conf.MaxAttachmentSize = 100
+
+	requests := []struct {
+		body   string
+		status int
+	}{
+		{`{"data":"a","attachments":[{"name":"a","data":"a"},{"name":"b","data":"b"},{"name":"c","data":"c"}]}`, http.StatusRequestEntityTooLarge},
+		{`{"data":"a","attachments":[{"name":"a","data":"` + strings.Repeat("a", 101) + `"}]}`, http.StatusRequestEntityTooLarge},
+		{`{"data":"a","attachments":[{"name":"` + strings.Repeat("a", maxAttachmentNameSize+1) + `","data":"a"}]}`, http.StatusRequestEntityTooLarge},
+		{`{"data":"a","attachments":[{"name":"a","data":""}]}`, http.StatusBadRequest},
+		{`{"data":"a","attachments":[{"name":"a"}]}`, http.StatusBadRequest},
+	}
+	for _, req := range requests {
+		antiflood.m = make(map[string]time.Time)
+		if w := post(req.body); w.Code != req.status {
+			t.Errorf("POST %.60q status == %d, want %d", req.body, w.Code, req.status)
+		}
+	}
+
+	antiflood.m = make(map[string]time.Time)
+	w := post(`{"data":"Paste","expire":60,"attachments":[{"name":"log","data":"Awesome log"},{"name":"png","data":"iVBORw0KGgo="}]}`)
+	var created Postresponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("POST response == %q: %s", w.Body.String(), err)
+	}
+
+	// Pastes hold attachment metadata only
+	paste, err := store.GetPaste(created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paste.Attachments) != 2 || paste.Attachments[0].Data != "" || paste.Attachments[0].Size != 11 {
+		t.Fatalf("paste attachments == %+v, want 2 attachments without data", paste.Attachments)
+	}
+	if index.size != paste.size() || paste.size() != int64(len("Paste")+len("Awesome log")+len("iVBORw0KGgo=")) {
+		t.Errorf("index size == %d, paste size == %d", index.size, paste.size())
+	}
+
+	for i, data := range []string{"Awesome log", "iVBORw0KGgo="} {
+		w := request(handlerAttachment, "GET", "/attachment/"+paste.Id+"/"+paste.Attachments[i].Id, "")
+		var attachment Attachment
+		if err := json.Unmarshal(w.Body.Bytes(), &attachment); err != nil || attachment.Data != data {
+			t.Errorf("GET /attachment #%d == %q, want data %q", i, w.Body.String(), data)
+		}
+	}
+	if w := request(handlerAttachment, "GET", "/attachment/"+paste.Id+"/"+newId(), ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /attachment of an unknown attachment status == %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// Attachments are deleted with the paste
+	if err := deletePaste(paste.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetAttachment(&paste, paste.Attachments[0].Id); err != ErrNotFound {
+		t.Errorf("GetAttachment() after delete error == %v, want %v", err, ErrNotFound)
+	}
+}
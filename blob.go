@@ -0,0 +1,129 @@
+package bingo
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+/*
+Paste record schemas.
+
+ - 1: a single json record holding the paste and its data (legacy records, without a schema field)
+ - 2: a json metadata record and a binary blob holding the paste data
+*/
+const pasteSchema = 2
+
+// Suffix of the blob key of a paste.
+const blobSuffix = ".bin"
+
+// Marker of the base64 ciphertext in a json envelope (as written by sjcl).
+const envelopeMarker = `"ct":"`
+
+/*
+Encoding of (encrypted) data stored as a binary blob.
+
+Data is stored as raw bytes when it is base64 (or a json envelope around
+base64 ciphertext), as is otherwise.
+
+ - Encoding: blob encoding, "base64", "envelope" or "text"
+ - Envelope: data without its ciphertext, for the "envelope" encoding
+ - Compression: codec of a paste blob, "none" if uncompressed, empty for blobs written before the codec was recorded (it is then guessed from the blob)
+*/
+type blobEncoding struct {
+	Encoding    string `json:"encoding,omitempty"`
+	Envelope    string `json:"envelope,omitempty"`
+	Compression string `json:"compression,omitempty"`
+}
+
+/*
+Metadata record of a paste.
+
+The paste data is stored in a separate blob, so that the metadata record can
+be read without loading the data.
+
+ - Schema: record schema, see pasteSchema
+ - Paste: paste, its data is not marshaled
+ - Data: paste data, in legacy records only
+ - Size: size of the paste data
+ - blobEncoding: encoding of the paste blob
+*/
+type pasteRecord struct {
+	Schema int `json:"schema,omitempty"`
+	*Paste
+	Data string `json:"data,omitempty"`
+	Size int64  `json:"size"`
+	blobEncoding
+}
+
+// Key of the blob of a paste.
+func blobKey(id string) string {
+	return id + blobSuffix
+}
+
+// Decode a base64 string, only if encoding the result gives it back.
+func decodeExactBase64(s string) ([]byte, bool) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || base64.StdEncoding.EncodeToString(raw) != s {
+		return nil, false
+	}
+	return raw, true
+}
+
+// Convert (encrypted) data to a binary blob.
+func encodeBlob(data string) (blobEncoding, []byte) {
+	// Plain base64 data
+	if raw, ok := decodeExactBase64(data); ok && data != "" {
+		return blobEncoding{Encoding: "base64"}, raw
+	}
+
+	// Base64 ciphertext in a json envelope
+	if i := strings.Index(data, envelopeMarker); i >= 0 {
+		start := i + len(envelopeMarker)
+		if n := strings.IndexByte(data[start:], '"'); n >= 0 {
+			if raw, ok := decodeExactBase64(data[start : start+n]); ok {
+				return blobEncoding{Encoding: "envelope", Envelope: data[:start] + data[start+n:]}, raw
+			}
+		}
+	}
+
+	return blobEncoding{Encoding: "text"}, []byte(data)
+}
+
+// Rebuild data from its binary blob.
+func (e *blobEncoding) decodeBlob(blob []byte) (string, error) {
+	switch e.Encoding {
+	case "base64":
+		return base64.StdEncoding.EncodeToString(blob), nil
+	case "envelope":
+		i := strings.Index(e.Envelope, envelopeMarker)
+		if i < 0 {
+			return "", fmt.Errorf("invalid data envelope")
+		}
+		start := i + len(envelopeMarker)
+		return e.Envelope[:start] + base64.StdEncoding.EncodeToString(blob) + e.Envelope[start:], nil
+	case "text":
+		return string(blob), nil
+	}
+	return "", fmt.Errorf("unknown data encoding %q", e.Encoding)
+}
+
+// Split a paste into a metadata record and a blob.
+func newPasteRecord(paste *Paste) (pasteRecord, []byte) {
+	encoding, blob := encodeBlob(paste.Data)
+	return pasteRecord{Schema: pasteSchema, Paste: pasteMeta(paste), Size: int64(len(paste.Data)), blobEncoding: encoding}, blob
+}
+
+// Copy of a paste for its metadata record.
+// Attachment data is not part of the metadata record.
+func pasteMeta(paste *Paste) *Paste {
+	meta := *paste
+	if len(paste.Attachments) > 0 {
+		meta.Attachments = make([]Attachment, len(paste.Attachments))
+		for i, a := range paste.Attachments {
+			a.Data = ""
+			meta.Attachments[i] = a
+		}
+	}
+	return &meta
+}
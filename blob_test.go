@@ -0,0 +1,107 @@
+package bingo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestPasteRecord(t *testing.T) {
+	raw := []byte{0, 1, 2, 0xfe, 0xff}
+	ct := base64.StdEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		data, encoding string
+		blob           []byte
+	}{
+		{ct, "base64", raw},
+		{`{"iv":"AAAA","v":1,"ct":"` + ct + `","mode":"ccm"}`, "envelope", raw},
+		{`{"iv":"AAAA","ct":"not base64"}`, "text", nil},
+		{"Awesome paste", "text", []byte("Awesome paste")},
+		{"", "text", []byte{}},
+	}
+
+	for _, test := range tests {
+		paste := newPaste(test.data)
+		rec, blob := newPasteRecord(&paste)
+		if rec.Encoding != test.encoding || rec.Size != int64(len(test.data)) {
+			t.Errorf("newPasteRecord(%q) == %s encoding and size %d, want %s and %d", test.data, rec.Encoding, rec.Size, test.encoding, len(test.data))
+		}
+		if test.blob != nil && !bytes.Equal(blob, test.blob) {
+			t.Errorf("newPasteRecord(%q) blob == %v, want %v", test.data, blob, test.blob)
+		}
+		if data, err := rec.decodeBlob(blob); err != nil || data != test.data {
+			t.Errorf("decodeBlob(newPasteRecord(%q)) == %q, %v", test.data, data, err)
+		}
+	}
+}
+
+func TestPasteSchema(t *testing.T) {
+	s := newMemoryStore()
+
+	// Legacy records hold the paste data
+	legacy := newPaste("1337")
+	s.b.put(legacy.Id, []byte(`{"data":"1337","burn":true}`))
+
+	paste := newPaste(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("Awesome paste"), 10)))
+	if err := s.CreatePaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []Paste{legacy, paste} {
+		loaded, err := s.GetPaste(p.Id)
+		if err != nil || loaded.Data != p.Data {
+			t.Errorf("GetPaste(%q) == %+v, %v, want data %q", p.Id, loaded, err, p.Data)
+		}
+		meta, size, err := s.GetMeta(p.Id)
+		if err != nil || meta.Data != "" || size != int64(len(p.Data)) {
+			t.Errorf("GetMeta(%q) == %+v, %d, %v, want no data and size %d", p.Id, meta, size, err, len(p.Data))
+		}
+	}
+
+	// The index is built from metadata only
+	s.b.put(blobKey(paste.Id), []byte("unreadable"))
+	sizes := make(map[string]int64)
+	if err := s.WalkMeta(func(p *Paste, size int64) error {
+		sizes[p.Id] = size
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkMeta() error: %s", err)
+	}
+	if len(sizes) != 2 || sizes[legacy.Id] != 4 || sizes[paste.Id] != int64(len(paste.Data)) {
+		t.Errorf("WalkMeta() sizes == %v", sizes)
+	}
+
+	// Newer schemas cannot be read
+	s.b.put(legacy.Id, []byte(`{"schema":3}`))
+	if _, err := s.GetPaste(legacy.Id); err == nil {
+		t.Errorf("GetPaste() of a schema 3 record succeeded")
+	}
+}
+
+func TestBlobCompression(t *testing.T) {
+	s := newMemoryStore()
+
+	// Raw blobs looking like compressed data
+	zlibHeader := base64.StdEncoding.EncodeToString([]byte{0x78, 0x9c, 1, 2, 3})
+	gzipHeader := base64.StdEncoding.EncodeToString([]byte{0x1f, 0x8b, 1, 2, 3})
+	pastes := []Paste{newPaste(zlibHeader), newPaste(gzipHeader)}
+	for i := range pastes {
+		if err := s.CreatePaste(&pastes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Read back whatever the current compression
+	for _, c := range append([]*codec{nil}, codecs...) {
+		s.codec = c
+		for _, p := range pastes {
+			if loaded, err := s.GetPaste(p.Id); err != nil || loaded.Data != p.Data {
+				t.Errorf("GetPaste(%q) with compression %s == %+v, %v, want data %q", p.Id, codecName(c), loaded, err, p.Data)
+			}
+		}
+		if _, err := s.rewrite(); err != nil {
+			t.Errorf("rewrite() with compression %s error: %s", codecName(c), err)
+		}
+	}
+}
@@ -1,138 +1,370 @@
 package bingo
 
 import (
-	"os"
-	"path/filepath"
-	"sort"
+	"container/heap"
 	"sync"
 	"time"
 )
 
 // An entry in the paste index.
+// expire is the date the cleaner handles the paste, see Paste.cleanDate, and
+// trashed tells whether the paste is in the trash.
+// pos is the position of the entry in the expiration heap.
 type indexEntry struct {
-	id     string
-	expire time.Time
+	id      string
+	expire  time.Time
+	size    int64
+	trashed bool
+	pos     int
 }
 
-// ByExpire implements sort.Interface for []indexEntry based on the expire field.
-type ByExpire []indexEntry
+// Whether an expiration date comes before another.
+// Pastes which never expire (zero date) come last.
+func expiresBefore(a, b time.Time) bool {
+	if a.IsZero() {
+		return false
+	}
+	return b.IsZero() || a.Before(b)
+}
+
+// expiryHeap implements heap.Interface for index entries, the entry expiring
+// first being at the top.
+type expiryHeap []*indexEntry
 
-func (a ByExpire) Len() int           { return len(a) }
-func (a ByExpire) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByExpire) Less(i, j int) bool { return a[i].expire.Before(a[j].expire) }
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return expiresBefore(h[i].expire, h[j].expire) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*indexEntry)
+	e.pos = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
 
 // Paste index.
-// RWMutex ensures safe concurrent access to the slice.
+// RWMutex ensures safe concurrent access to the heap and the map.
+// h orders pastes by expiration date, ids gives the entry of a paste.
+// size is the total size of indexed pastes.
+// wake is signaled when the first expiration date of the index changes.
 var index = struct {
 	sync.RWMutex
-	s []indexEntry
+	h    expiryHeap
+	ids  map[string]*indexEntry
+	size int64
+	wake chan struct{}
 }{
-	s: make([]indexEntry, 0, 10),
+	h:    make(expiryHeap, 0, 10),
+	ids:  make(map[string]*indexEntry),
+	wake: make(chan struct{}, 1),
+}
+
+// Signal the cleaner that the first expiration date of the index changed.
+func wakeCleaner() {
+	select {
+	case index.wake <- struct{}{}:
+	default:
+		// Already signaled
+	}
+}
+
+// Add an entry to the index, replacing the entry of the same paste if any.
+// Caller must hold the index lock.
+func addIndexEntry(e indexEntry) {
+	if old, ok := index.ids[e.id]; ok {
+		index.size -= old.size
+		heap.Remove(&index.h, old.pos)
+	}
+	entry := &e
+	heap.Push(&index.h, entry)
+	index.ids[e.id] = entry
+	index.size += e.size
+	if entry.pos == 0 {
+		wakeCleaner()
+	}
+}
+
+// Replace the index content.
+// Caller must hold the index lock.
+func resetIndex(entries []indexEntry) {
+	index.h = make(expiryHeap, 0, len(entries))
+	index.ids = make(map[string]*indexEntry, len(entries))
+	index.size = 0
+	for i := range entries {
+		e := &entries[i]
+		e.pos = len(index.h)
+		index.h = append(index.h, e)
+		index.ids[e.id] = e
+		index.size += e.size
+	}
+	heap.Init(&index.h)
+	wakeCleaner()
 }
 
 // Add a paste to the index.
+// The paste expires according to the retention policy.
 func (paste *Paste) index() {
+	size := paste.size()
 	index.Lock()
-	index.s = append(index.s, indexEntry{paste.Id, paste.Expire})
+	addIndexEntry(indexEntry{id: paste.Id, expire: retainedUntil(paste, size), size: size})
 	index.Unlock()
 }
 
-// Build the paste index from disk.
-func buildIndex() error {
-	Loggers.Info.Println("Build paste index...")
-	e := indexFolder(conf.Root, "")
-	Loggers.Info.Printf("Paste index built with %d entries", len(index.s))
-	return e
+// Remove a paste from the index.
+func unindex(id string) {
+	index.Lock()
+	defer index.Unlock()
+	if e, ok := index.ids[id]; ok {
+		index.size -= e.size
+		heap.Remove(&index.h, e.pos)
+		delete(index.ids, id)
+	}
+}
+
+// Account for data added to an indexed paste (eg. a comment).
+// The paste may now match retention rules bringing its expiration forward.
+func indexGrow(paste *Paste, size int64) {
+	updateIndexEntry(paste.Id, func(e *indexEntry) {
+		e.size += size
+		index.size += size
+		if e.trashed {
+			return
+		}
+		if retained := retainedUntil(paste, e.size); expiresBefore(retained, e.expire) {
+			e.expire = retained
+		}
+	})
+}
+
+// Update the expiration date of an indexed paste.
+func indexExpire(id string, expire time.Time) {
+	updateIndexEntry(id, func(e *indexEntry) {
+		e.expire = expire
+	})
+}
+
+// Move an indexed paste to the trash or out of it, the cleaner handling it
+// at date. Returns false if the paste is not indexed.
+func indexTrash(id string, trashed bool, date time.Time) bool {
+	return updateIndexEntry(id, func(e *indexEntry) {
+		e.expire, e.trashed = date, trashed
+	})
+}
+
+// Update the entry of an indexed paste with fn, keeping the heap order.
+// Returns false if the paste is not indexed.
+func updateIndexEntry(id string, fn func(e *indexEntry)) bool {
+	index.Lock()
+	defer index.Unlock()
+	e, ok := index.ids[id]
+	if !ok {
+		return false
+	}
+	fn(e)
+	heap.Fix(&index.h, e.pos)
+	if e.pos == 0 {
+		wakeCleaner()
+	}
+	return true
 }
 
-// Scan a folder for paste indexing.
-// This function is called recursively when a subfolder is encountered.
-// prefix keps track of the folder hierarchy to rebuild pastes ids.
-func indexFolder(path, prefix string) error {
-	matches, err := filepath.Glob(filepath.Join(path, "*"))
-	if err != nil {
-		return err
+// Expiration date of the paste expiring first, if any.
+func nextExpiration() (time.Time, bool) {
+	index.RLock()
+	defer index.RUnlock()
+	if len(index.h) == 0 || index.h[0].expire.IsZero() {
+		return time.Time{}, false
 	}
+	return index.h[0].expire, true
+}
 
-	for _, match := range matches {
-		stat, e := os.Stat(match)
-		if e != nil {
-			return e
+// Build the paste index from the store.
+// Only paste metadata is loaded, and the built index replaces the current one.
+func buildIndex() error {
+	Loggers.Info.Println("Build paste index...")
+	entries := make([]indexEntry, 0, 10)
+	var size int64
+	e := store.WalkMeta(func(paste *Paste, dataSize int64) error {
+		n := indexedSize(paste, dataSize)
+		expire := paste.cleanDate()
+		if paste.Trashed.IsZero() {
+			expire = retainedUntil(paste, n)
 		}
+		entries = append(entries, indexEntry{id: paste.Id, expire: expire, size: n, trashed: !paste.Trashed.IsZero()})
+		size += n
+		return nil
+	})
 
-		if stat.IsDir() {
-			// Recursively index folder
-			// Unless this is a discussion folder (ends with _)
-			if match[len(match)-1:] != "_" {
-				indexFolder(match, prefix+filepath.Base(match))
-			}
-		}
+	index.Lock()
+	resetIndex(entries)
+	index.Unlock()
+	Loggers.Info.Printf("Paste index built with %d entries (%d bytes)", len(entries), size)
+	return e
+}
 
-		if stat.Mode().IsRegular() {
-			// Regular file, load and index paste
-			paste, loadError := loadPaste(prefix + filepath.Base(match))
-			if loadError != nil {
-				return loadError
-			}
-			paste.index()
+// Size of a paste loaded without its data, as accounted by the index: its
+// data, comments, revisions and attachments.
+func indexedSize(paste *Paste, dataSize int64) int64 {
+	if paste.Discussion {
+		// Comments count in the paste size
+		comments, err := store.ListComments(paste)
+		if err != nil {
+			Loggers.Error.Printf("Cannot load comments of paste %s: %s", paste.Id, err)
 		}
+		paste.Comments = comments
 	}
+	// Paste data is not loaded, its size is given by the metadata
+	n := dataSize + paste.size()
+	if paste.Revision > 0 {
+		// Previous revisions count in the paste size
+		revisions, err := store.ListRevisions(paste)
+		if err != nil {
+			Loggers.Error.Printf("Cannot load revisions of paste %s: %s", paste.Id, err)
+		}
+		for i := range revisions {
+			n += revisions[i].size()
+		}
+	}
+	return n
+}
+
+// Remove the pastes expiring first from the index, while keep returns false.
+// Returns the removed entries.
+func unindexFirst(keep func(e indexEntry) bool) []indexEntry {
+	index.Lock()
+	defer index.Unlock()
 
-	return nil
+	removed := make([]indexEntry, 0)
+	for len(index.h) > 0 && !keep(*index.h[0]) {
+		e := heap.Pop(&index.h).(*indexEntry)
+		delete(index.ids, e.id)
+		index.size -= e.size
+		removed = append(removed, *e)
+	}
+	return removed
 }
 
-// Delete expired pastes from disk according to index data.
+// Delete expired pastes from the store according to index data.
+// With a trash, expired pastes are moved to the trash, and pastes at the end
+// of their grace period are purged.
+// Pastes under legal hold are kept, and checked again CleanThreshold seconds
+// later, so that they are deleted once released.
 func deleteExpiredPastes() {
 	Loggers.Info.Println("Delete expired pastes according to index data")
 
-	// Sort the index by increasing expiration dates
-	index.Lock()
-	sort.Sort(ByExpire(index.s))
-	index.Unlock()
+	// Remove expired pastes from index (they are at the top of the heap, if any)
+	now := time.Now()
+	expired := unindexFirst(func(e indexEntry) bool {
+		return !expiresBefore(e.expire, now)
+	})
 
-	// Remove expired pastes (they are at the beginning, if any)
-	max := -1
-	for i, e := range index.s {
-		if e.expire.Before(time.Now()) {
-			// This paste has expired
-			max = i
-			paste, loadError := loadPaste(e.id)
-			if loadError != nil {
-				Loggers.Warn.Printf("Paste %s must be deleted (expired) but cannot be loaded (maybe already deleted ?): %s", e.id, loadError.Error())
+	for _, e := range expired {
+		if e.trashed {
+			if err := store.PurgePaste(e.id); err == ErrHeld {
+				keepHeldPaste(e)
+			} else if err != nil && err != ErrNotFound {
+				Loggers.Error.Printf("Cannot purge paste %s from the trash: %s", e.id, err)
+			}
+			continue
+		}
+		if hasTrash() {
+			paste, err := store.TrashPaste(e.id)
+			if err == ErrHeld {
+				keepHeldPaste(e)
+			} else if err == ErrNotFound {
+				Loggers.Warn.Printf("Paste %s must be moved to the trash (expired) but cannot be found (maybe already deleted ?)", e.id)
+			} else if err != nil {
+				Loggers.Error.Printf("Cannot move expired paste %s to the trash: %s", e.id, err)
 			} else {
-				if delError := paste.del(); delError != nil {
-					Loggers.Error.Printf("Cannot delete expired paste %s: %s", e.id, delError.Error())
-				}
+				index.Lock()
+				addIndexEntry(indexEntry{id: e.id, expire: paste.cleanDate(), size: e.size, trashed: true})
+				index.Unlock()
 			}
-		} else {
-			// We found a non-expired paste, stop here
-			break
+			continue
+		}
+		if delError := store.DeletePaste(e.id); delError == ErrHeld {
+			keepHeldPaste(e)
+		} else if delError == ErrNotFound {
+			Loggers.Warn.Printf("Paste %s must be deleted (expired) but cannot be found (maybe already deleted ?)", e.id)
+		} else if delError != nil {
+			Loggers.Error.Printf("Cannot delete expired paste %s: %s", e.id, delError.Error())
 		}
 	}
+}
+
+// Put back the index entry of an expired paste under legal hold, to be
+// checked again CleanThreshold seconds later.
+func keepHeldPaste(e indexEntry) {
+	Loggers.Info.Printf("Paste %s has expired but is under legal hold, keep", e.id)
+	e.expire = time.Now().Add(time.Duration(conf.CleanThreshold) * time.Second)
+	index.Lock()
+	addIndexEntry(e)
+	index.Unlock()
+}
 
-	// Remove deleted pastes from index
-	if max >= 0 {
-		index.Lock()
-		index.s = index.s[max+1:]
-		index.Unlock()
+// Delay until the next run of the cleaner: the next expiration date, or
+// CleanThreshold seconds at most.
+func cleanDelay() time.Duration {
+	delay := time.Duration(conf.CleanThreshold) * time.Second
+	if next, ok := nextExpiration(); ok {
+		if d := next.Sub(time.Now()); d < delay {
+			delay = d
+		}
+	}
+	if delay < 0 {
+		delay = 0
 	}
+	return delay
 }
 
 // Start the clean daemon.
+// The cleaner wakes up when the first indexed paste expires, and at least
+// once in CleanThreshold seconds.
+// A shared storage (eg. s3) may be written by other servers, so the index is
+// then built again from the store once in CleanThreshold seconds.
 func startCleanDaemon() {
 	Loggers.Info.Printf("Start clean daemon with a %d seconds threshold", conf.CleanThreshold)
-	tick := time.NewTicker(time.Duration(conf.CleanThreshold) * time.Second).C
+	threshold := time.Duration(conf.CleanThreshold) * time.Second
 	go func() {
-		for _ = range tick {
+		rebuild := time.Now().Add(threshold)
+		for {
+			timer := time.NewTimer(cleanDelay())
+			select {
+			case <-timer.C:
+			case <-index.wake:
+				// The next expiration date changed
+				timer.Stop()
+				continue
+			}
+
+			if conf.Storage == "s3" && !time.Now().Before(rebuild) {
+				if err := buildIndex(); err != nil {
+					Loggers.Error.Printf("Cannot build paste index: %s", err)
+				}
+				rebuild = time.Now().Add(threshold)
+			}
 			deleteExpiredPastes()
 		}
 	}()
 }
 
-// Debug function that prints the index content.
+// Debug function that prints the index content, in heap order.
 func printIndex() {
+	index.RLock()
+	defer index.RUnlock()
 	Loggers.Trace.Println("=== Index ===")
-	for i, e := range index.s {
+	for i, e := range index.h {
 		Loggers.Trace.Printf("#%d %s at %s", i, e.id, e.expire)
 	}
 	Loggers.Trace.Println("=============")
@@ -0,0 +1,59 @@
+package bingo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	conf.CleanThreshold = 3600
+
+	if delay := cleanDelay(); delay != time.Hour {
+		t.Errorf("cleanDelay() of an empty index == %s, want %s", delay, time.Hour)
+	}
+
+	now := time.Now()
+	pastes := make([]Paste, 5)
+	for i := range pastes {
+		pastes[i] = newPaste("Awesome paste")
+		pastes[i].Expire = now.Add(time.Duration(len(pastes)-i) * time.Minute)
+		pastes[i].index()
+	}
+	<-index.wake
+
+	// Removing pastes keeps the expiration order
+	unindex(pastes[4].Id)
+	unindex(pastes[2].Id)
+	indexGrow(&pastes[3], 10)
+	if next, ok := nextExpiration(); !ok || !next.Equal(pastes[3].Expire) {
+		t.Errorf("nextExpiration() == %s, %v, want %s", next, ok, pastes[3].Expire)
+	}
+	if delay := cleanDelay(); delay <= time.Minute || delay > 2*time.Minute {
+		t.Errorf("cleanDelay() == %s, want about 2 minutes", delay)
+	}
+
+	removed := unindexFirst(func(e indexEntry) bool {
+		return e.id == pastes[0].Id
+	})
+	if len(removed) != 2 || removed[0].id != pastes[3].Id || removed[1].id != pastes[1].Id || removed[0].size != pastes[3].size()+10 {
+		t.Errorf("unindexFirst() == %+v, want pastes 3 and 1", removed)
+	}
+	if len(index.h) != 1 || index.size != pastes[0].size() {
+		t.Errorf("index holds %d pastes of %d bytes, want paste 0", len(index.h), index.size)
+	}
+
+	// Indexing an expired paste wakes the cleaner up
+	expired := newPaste("Expired paste")
+	expired.Expire = now.Add(-time.Minute)
+	expired.index()
+	select {
+	case <-index.wake:
+	default:
+		t.Errorf("cleaner not woken up by an expired paste")
+	}
+	if delay := cleanDelay(); delay != 0 {
+		t.Errorf("cleanDelay() with an expired paste == %s, want 0", delay)
+	}
+}
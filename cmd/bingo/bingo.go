@@ -2,7 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/reenjii/bingo"
 )
@@ -15,9 +19,227 @@ func init() {
 	bingo.Loggers.Info.Println("Bingo initialization")
 
 	flag.StringVar(&conf, "conf", "/etc/bingo.json", "Configuration file path")
+	flag.Usage = usage
+}
+
+// Print command line usage.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-conf file] [command] [arguments]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  serve           run the web server (default)")
+	fmt.Fprintln(os.Stderr, "  migrate-layout  move pastes to another storage depth")
+	fmt.Fprintln(os.Stderr, "  export          write all pastes to a tar archive")
+	fmt.Fprintln(os.Stderr, "  import          load pastes from a tar archive")
+	fmt.Fprintln(os.Stderr, "  rekey           rewrite stored records with the current encryption key")
+	fmt.Fprintln(os.Stderr, "  fsck            check the data folder, and repair it with -repair")
+	fmt.Fprintln(os.Stderr, "  hold            place a legal hold on a paste")
+	fmt.Fprintln(os.Stderr, "  holds           list the pastes under legal hold")
+	fmt.Fprintln(os.Stderr, "  release         release the legal hold of a paste")
+	fmt.Fprintln(os.Stderr, "  retention-report  report the pastes the retention policy deletes early")
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// Exit with an error message.
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
 }
 
 func main() {
 	flag.Parse()
-	bingo.Serve(conf)
+
+	command := "serve"
+	args := flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		bingo.Serve(conf)
+	case "migrate-layout":
+		migrateLayout(args)
+	case "export":
+		export(args)
+	case "import":
+		importArchive(args)
+	case "rekey":
+		rekey(args)
+	case "fsck":
+		fsck(args)
+	case "hold":
+		hold(args)
+	case "holds":
+		holds(args)
+	case "release":
+		release(args)
+	case "retention-report":
+		retentionReport(args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// Run the migrate-layout command.
+func migrateLayout(args []string) {
+	flags := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	depth := flags.Int("depth", -1, "Target depth")
+	dryRun := flags.Bool("dry-run", false, "Only report planned moves")
+	flags.Parse(args)
+
+	if *depth < 0 {
+		fmt.Fprintln(os.Stderr, "Usage: bingo migrate-layout -depth n [-dry-run]")
+		os.Exit(2)
+	}
+
+	if err := bingo.MigrateLayout(conf, *depth, *dryRun, os.Stdout); err != nil {
+		fail(err)
+	}
+}
+
+// Run the export command.
+func export(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "", "Archive file path")
+	compress := flags.Bool("gzip", false, "Compress the archive with gzip (default when the path ends with .gz)")
+	flags.Parse(args)
+
+	if *output == "" {
+		fmt.Fprintln(os.Stderr, "Usage: bingo export -o archive.tar[.gz] [-gzip]")
+		os.Exit(2)
+	}
+
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		fail(err)
+	}
+
+	report, err := bingo.Export(conf, f, *compress || strings.HasSuffix(*output, ".gz"))
+	if err != nil {
+		f.Close()
+		fail(err)
+	}
+	if err := f.Close(); err != nil {
+		fail(err)
+	}
+
+	fmt.Printf("Exported %d pastes, %d comments, %d revisions and %d attachments to %s\n", report.Pastes, report.Comments, report.Revisions, report.Attachments, *output)
+}
+
+// Run the import command.
+func importArchive(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: bingo import archive.tar[.gz]")
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	defer f.Close()
+
+	report, err := bingo.Import(conf, f)
+	fmt.Printf("Imported %d pastes, %d comments, %d revisions and %d attachments, skipped %d expired pastes\n", report.Pastes, report.Comments, report.Revisions, report.Attachments, report.Expired)
+	for _, id := range report.Conflicts {
+		fmt.Printf("Conflict: paste %s already exists\n", id)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// Run the rekey command.
+func rekey(args []string) {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	flags.Parse(args)
+
+	n, err := bingo.Rekey(conf)
+	fmt.Printf("%d records rewritten\n", n)
+	if err != nil {
+		fail(err)
+	}
+}
+
+// Run the fsck command.
+// Exits with status 1 when problems are left unrepaired.
+func fsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "Repair problems")
+	flags.Parse(args)
+
+	report, err := bingo.Fsck(conf, *repair, os.Stdout)
+	if err != nil {
+		fail(err)
+	}
+	if report.Unreadable+report.Mismatched+report.Orphans+report.MissingParents+report.Expired > report.Repaired {
+		os.Exit(1)
+	}
+}
+
+// Run the hold command.
+func hold(args []string) {
+	flags := flag.NewFlagSet("hold", flag.ExitOnError)
+	reason := flags.String("reason", "", "Why the paste is held, eg. a case reference")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *reason == "" {
+		fmt.Fprintln(os.Stderr, "Usage: bingo hold -reason text id")
+		os.Exit(2)
+	}
+
+	if err := bingo.PlaceHold(conf, flags.Arg(0), *reason); err != nil {
+		fail(err)
+	}
+	fmt.Printf("Paste %s is under legal hold\n", flags.Arg(0))
+}
+
+// Run the holds command.
+func holds(args []string) {
+	flags := flag.NewFlagSet("holds", flag.ExitOnError)
+	flags.Parse(args)
+
+	pastes, err := bingo.ListHolds(conf)
+	if err != nil {
+		fail(err)
+	}
+	for _, paste := range pastes {
+		trash := ""
+		if !paste.Trashed.IsZero() {
+			trash = " (in the trash)"
+		}
+		fmt.Printf("%s held since %s%s: %s\n", paste.Id, paste.Hold.Date.Format(time.RFC3339), trash, paste.Hold.Reason)
+	}
+	fmt.Printf("%d pastes under legal hold\n", len(pastes))
+}
+
+// Run the release command.
+func release(args []string) {
+	flags := flag.NewFlagSet("release", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: bingo release id")
+		os.Exit(2)
+	}
+
+	if err := bingo.ReleaseHold(conf, flags.Arg(0)); err != nil {
+		fail(err)
+	}
+	fmt.Printf("Legal hold of paste %s released\n", flags.Arg(0))
+}
+
+// Run the retention-report command.
+func retentionReport(args []string) {
+	flags := flag.NewFlagSet("retention-report", flag.ExitOnError)
+	flags.Parse(args)
+
+	if _, err := bingo.ReportRetention(conf, os.Stdout); err != nil {
+		fail(err)
+	}
 }
@@ -0,0 +1,119 @@
+package bingo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+/*
+A compression codec for stored records.
+
+ - name: codec name, as used in the configuration
+ - match: whether data was compressed by this codec
+ - writer: create a compressing writer
+ - reader: create a decompressing reader
+*/
+type codec struct {
+	name   string
+	match  func(data []byte) bool
+	writer func(w io.Writer) io.WriteCloser
+	reader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// Available codecs.
+// Records written without compression (including legacy ones) are plain json.
+var codecs = []*codec{
+	{
+		name: "gzip",
+		match: func(data []byte) bool {
+			return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+		},
+		writer: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		reader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	{
+		name: "zlib",
+		match: func(data []byte) bool {
+			// Deflate method and valid header checksum
+			return len(data) >= 2 && data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0
+		},
+		writer: func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		reader: func(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) },
+	},
+}
+
+// Find a codec by name.
+// No codec is returned for "none".
+func findCodec(name string) (*codec, error) {
+	if name == "none" || name == "" {
+		return nil, nil
+	}
+	for _, c := range codecs {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return nil, &configError{fmt.Sprintf("unknown compression %q", name)}
+}
+
+// Compress data with a codec, if any.
+func compress(c *codec, data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	w := c.writer(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Name of a codec, "none" without codec.
+func codecName(c *codec) string {
+	if c == nil {
+		return "none"
+	}
+	return c.name
+}
+
+// Decompress data with the codec of the given name.
+// Without name, the codec is guessed from the data, see decompress.
+func decompressWith(name string, data []byte) ([]byte, error) {
+	if name == "" {
+		return decompress(data)
+	}
+	c, err := findCodec(name)
+	if err != nil || c == nil {
+		return data, err
+	}
+	return decompressCodec(c, data)
+}
+
+// Decompress data with a codec.
+func decompressCodec(c *codec, data []byte) ([]byte, error) {
+	r, err := c.reader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Decompress data with the codec that compressed it, guessed from the data.
+// Uncompressed data is returned as is.
+func decompress(data []byte) ([]byte, error) {
+	for _, c := range codecs {
+		if c.match(data) {
+			return decompressCodec(c, data)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,41 @@
+package bingo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressedStore(t *testing.T) {
+	for _, c := range codecs {
+		s := newMemoryStore()
+		s.codec = c
+		testStore(t, s)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	data := []byte(`{"data":"` + string(bytes.Repeat([]byte("Awesome paste"), 100)) + `"}`)
+
+	for _, c := range codecs {
+		compressed, err := compress(c, data)
+		if err != nil {
+			t.Fatalf("compress(%s) error: %s", c.name, err)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("compress(%s) gave %d bytes out of %d", c.name, len(compressed), len(data))
+		}
+		decompressed, err := decompress(compressed)
+		if err != nil {
+			t.Fatalf("decompress(%s) error: %s", c.name, err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Errorf("decompress(compress(%s)) differs from input", c.name)
+		}
+	}
+
+	// Legacy records are plain json
+	legacy, err := decompress(data)
+	if err != nil || !bytes.Equal(legacy, data) {
+		t.Errorf("decompress(<json>) == %q, %v, want input unchanged", legacy, err)
+	}
+}
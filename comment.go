@@ -1,12 +1,6 @@
 package bingo
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
-	"encoding/json"
-	"io/ioutil"
-	"path"
-	"path/filepath"
 	"time"
 )
 
@@ -39,77 +33,59 @@ func (a CommentsByDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a CommentsByDate) Less(i, j int) bool { return a[i].Postdate.Before(a[j].Postdate) }
 
 // Create a new comment.
-// Setup comment postdate and id.
+// Setup comment postdate and a random id.
 func newComment(data string, parent *Comment) Comment {
 	comment := Comment{
+		Id:       newId(),
 		Data:     data,
 		Postdate: time.Now(),
 	}
 	if parent != nil {
 		comment.Parent = parent.Id
 	}
-	comment.computeId()
 	return comment
 }
 
-// Compute comment id.
-func (comment *Comment) computeId() {
-	hash := sha1.Sum([]byte(comment.Data))
-	comment.Id = hex.EncodeToString(hash[:10])
-}
-
-// Compute avatar
-func (comment *Comment) computeAvatar(ip string) {
-	a := Avatar{X: 32, Y: 32}
-	comment.Avatar = a.Avatar(ip)
-}
-
-// Compute the storage path of a comment.
-func (comment *Comment) storagePath(paste *Paste) string {
-	// Compute paste discussion folder
-	s := paste.discussionPath()
-	// Build comment path
-	s = filepath.Clean(path.Join(s, comment.Id))
-	Loggers.Info.Printf("Computed comment storage path %s", s)
-	return s
+// Save a new comment to the store and account for it in the index.
+// Room is made for the comment according to the quota, and a new id is
+// drawn as long as the comment id is already in use.
+func createComment(paste *Paste, comment *Comment) error {
+	for i := 1; ; i++ {
+		err := saveComment(paste, comment)
+		if err != ErrExists || i == idAttempts {
+			return err
+		}
+		Loggers.Warn.Printf("Comment id %s is already in use, draw another one", comment.Id)
+		comment.Id = newId()
+	}
 }
 
-// Save a comment to disk.
-func (comment *Comment) save(paste *Paste) error {
-	Loggers.Info.Printf("Save comment %s", comment.Id)
-
-	p := comment.storagePath(paste)
-
-	if err := setupFolder(filepath.Dir(p), 0770); err != nil {
-		return err
+// Save a new comment to the store and account for it in the index.
+// Room is made for the comment according to the quota, and ErrExists is
+// returned if the comment id is already in use.
+func saveComment(paste *Paste, comment *Comment) error {
+	if hasQuota() {
+		quotaLock.Lock()
+		defer quotaLock.Unlock()
+		if err := makeRoom(comment.size(), 0, paste.Id); err != nil {
+			return err
+		}
 	}
 
-	// Marshal comment
-	s, err := json.Marshal(comment)
-	if err != nil {
+	if err := store.AppendComment(paste, comment); err != nil {
 		return err
 	}
-
-	return ioutil.WriteFile(p, s, 0640)
+	indexGrow(paste, comment.size())
+	return nil
 }
 
-// Load a comment from disk.
-func loadComment(id string, paste *Paste) (Comment, error) {
-	Loggers.Info.Printf("Load comment %s", id)
-
-	comment := &Comment{Id: id}
-	p := comment.storagePath(paste)
-
-	// Read file
-	data, err := ioutil.ReadFile(p)
-	if err != nil {
-		return Comment{}, err
-	}
-
-	// Unmarshal data
-	if err := json.Unmarshal(data, &comment); err != nil {
-		return Comment{}, err
-	}
+// Approximate storage size of a comment.
+func (comment *Comment) size() int64 {
+	return int64(len(comment.Data) + len(comment.Author) + len(comment.Avatar))
+}
 
-	return *comment, nil
+// Compute avatar
+func (comment *Comment) computeAvatar(ip string) {
+	a := Avatar{X: 32, Y: 32}
+	comment.Avatar = a.Avatar(ip)
 }
@@ -2,6 +2,7 @@ package bingo
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
 )
@@ -18,7 +19,47 @@ Application configuration.
  - Port: webapp port
  - Depth: number of subfolders in data hierarchy (the more, the more folders, the fewer files per folder)
  - FloodThreshold: min delay (in seconds) between two posts for a single user
- - CleanThreshold: delete expired pasted from database once in that many seconds
+ - CleanThreshold: check for expired pastes at least once in that many seconds (expired pastes are deleted as soon as they expire)
+ - SnapshotInterval: write a snapshot of the paste index to Root once in that many seconds, 0 to only write it on startup and shutdown
+ - ExpireChoices: allowed paste lifetimes, in seconds, offered in the paste form
+ - NeverExpire: whether pastes may never expire, unless MaxLifetime is set
+ - MaxLifetime: maximum paste lifetime, in seconds, 0 for no limit
+ - Retention: retention rules, capping the lifetime of the pastes they match, see RetentionRule
+ - TrashGrace: keep deleted and expired pastes in the trash for that many seconds, so that their owner can restore them, 0 to delete them at once
+ - IdLength: number of characters of paste and comment ids
+ - IdAlphabet: characters of paste and comment ids, "hex", "base62" or a list of letters and digits
+ - Storage: storage backend, "files" (one file per paste in Root), "journal" (a single log file) or "s3" (an S3-compatible bucket)
+ - Journal: journal file path (defaults to bingo.journal in Root)
+ - CompactThreshold: check whether the journal needs compaction once in that many seconds
+ - S3Endpoint: S3 server URL, eg. https://s3.eu-west-1.amazonaws.com
+ - S3Bucket: S3 bucket name
+ - S3Prefix: prefix of S3 object keys, eg. "bingo/"
+ - S3Region: S3 bucket region
+ - S3AccessKey: S3 access key id
+ - S3SecretKey: S3 secret access key
+ - Compression: compression of stored records, "gzip", "zlib" or "none"
+ - TokenKey: secret key of delete tokens, generated in Root (token.key) when empty; servers sharing a storage need the same key
+ - EncryptionKey: base64 AES key (16, 24 or 32 bytes) encrypting stored records, empty to store them in clear
+ - OldEncryptionKeys: previous encryption keys, still used to read records until they are rewritten by "bingo rekey"
+ - MaxPasteSize: maximum size of a paste (encrypted) data, in bytes
+ - MaxCommentSize: maximum size of a comment (encrypted) data, in bytes
+ - MaxAuthorSize: maximum size of a comment (encrypted) author, in bytes
+ - MaxAttachmentSize: maximum size of a paste attachment (encrypted) data, in bytes
+ - MaxAttachments: maximum number of attachments of a paste, 0 to disable attachments
+ - QuotaBytes: maximum total size of stored pastes and comments, 0 for no limit
+ - QuotaPastes: maximum number of stored pastes, 0 for no limit
+ - QuotaPolicy: when the quota is exceeded, "reject" new data or "evict" the pastes closest to their expiration date
+
+Retention and TrashGrace are disabled by default. For instance, to keep
+burnable pastes a day, discussions a month and pastes of 1MiB or more an hour,
+and to keep deleted pastes a day in the trash:
+
+	"trashGrace": 86400,
+	"retention": [
+		{"name": "burn", "burn": true, "maxLifetime": 86400},
+		{"name": "discussion", "discussion": true, "maxLifetime": 2592000},
+		{"name": "large", "minSize": 1048576, "maxLifetime": 3600}
+	],
 */
 type Conf struct {
 	Root           string `json:"root"`
@@ -31,6 +72,48 @@ type Conf struct {
 	Depth          int    `json:"depth"`
 	FloodThreshold int    `json:"floodThreshold"`
 	CleanThreshold int    `json:"cleanThreshold"`
+
+	SnapshotInterval int `json:"snapshotInterval"`
+
+	ExpireChoices []int `json:"expireChoices"`
+	NeverExpire   bool  `json:"neverExpire"`
+	MaxLifetime   int   `json:"maxLifetime"`
+
+	Retention []RetentionRule `json:"retention"`
+
+	TrashGrace int `json:"trashGrace"`
+
+	IdLength   int    `json:"idLength"`
+	IdAlphabet string `json:"idAlphabet"`
+
+	Storage          string `json:"storage"`
+	Journal          string `json:"journal"`
+	CompactThreshold int    `json:"compactThreshold"`
+
+	S3Endpoint  string `json:"s3Endpoint"`
+	S3Bucket    string `json:"s3Bucket"`
+	S3Prefix    string `json:"s3Prefix"`
+	S3Region    string `json:"s3Region"`
+	S3AccessKey string `json:"s3AccessKey"`
+	S3SecretKey string `json:"s3SecretKey"`
+
+	Compression string `json:"compression"`
+
+	TokenKey string `json:"tokenKey"`
+
+	EncryptionKey     string   `json:"encryptionKey"`
+	OldEncryptionKeys []string `json:"oldEncryptionKeys"`
+
+	MaxPasteSize   int64 `json:"maxPasteSize"`
+	MaxCommentSize int64 `json:"maxCommentSize"`
+	MaxAuthorSize  int64 `json:"maxAuthorSize"`
+
+	MaxAttachmentSize int64 `json:"maxAttachmentSize"`
+	MaxAttachments    int   `json:"maxAttachments"`
+
+	QuotaBytes  int64  `json:"quotaBytes"`
+	QuotaPastes int    `json:"quotaPastes"`
+	QuotaPolicy string `json:"quotaPolicy"`
 }
 
 // Global configuration instance
@@ -39,12 +122,33 @@ var conf Conf
 // Initializes configuration defaults
 func init() {
 	conf = Conf{
-		Verbosity:      15, // All logs
-		Port:           1337,
-		Depth:          2,
-		FloodThreshold: 10,
-		CleanThreshold: 3600, // One hour
-		Stdout:         false,
+		Verbosity:        15, // All logs
+		Port:             1337,
+		Depth:            2,
+		FloodThreshold:   10,
+		CleanThreshold:   3600, // One hour
+		SnapshotInterval: 600,  // Ten minutes
+
+		// 5 seconds to 1 year
+		ExpireChoices: []int{5, 60, 300, 3600, 86400, 604800, 2592000, 31536000},
+		Stdout:        false,
+
+		IdLength:   20,
+		IdAlphabet: "hex",
+
+		Storage:          "files",
+		CompactThreshold: 3600, // One hour
+		S3Region:         "us-east-1",
+		Compression:      "gzip",
+
+		MaxPasteSize:   2 << 20,  // 2 MiB
+		MaxCommentSize: 64 << 10, // 64 KiB
+		MaxAuthorSize:  1 << 10,  // 1 KiB
+
+		MaxAttachmentSize: 8 << 20, // 8 MiB
+		MaxAttachments:    4,
+
+		QuotaPolicy: "reject",
 	}
 }
 
@@ -69,6 +173,86 @@ func (conf *Conf) load(path string) error {
 	if conf.Log != "" {
 		conf.Log = filepath.Clean(conf.Log)
 	}
+	if conf.Journal == "" {
+		conf.Journal = filepath.Join(conf.Root, "bingo.journal")
+	}
+	conf.Journal = filepath.Clean(conf.Journal)
+
+	// Check id format
+	if _, err := resolveIdAlphabet(conf.IdAlphabet); err != nil {
+		return err
+	}
+	if conf.IdLength <= 2*conf.Depth {
+		return fmt.Errorf("id length %d is too short for depth %d", conf.IdLength, conf.Depth)
+	}
+
+	// Check storage
+	switch conf.Storage {
+	case "files", "journal":
+	case "s3":
+		if conf.S3Endpoint == "" || conf.S3Bucket == "" {
+			return fmt.Errorf("s3 storage needs an endpoint and a bucket")
+		}
+	default:
+		return fmt.Errorf("unknown storage %q", conf.Storage)
+	}
+
+	// Check compression
+	if _, err := findCodec(conf.Compression); err != nil {
+		return err
+	}
+
+	// Check encryption keys
+	if _, err := newSealer(conf.EncryptionKey, conf.OldEncryptionKeys); err != nil {
+		return err
+	}
+
+	// Check expiration policy
+	if len(conf.ExpireChoices) == 0 && !conf.allowNeverExpire() {
+		return fmt.Errorf("no paste lifetime is allowed")
+	}
+	for _, seconds := range conf.ExpireChoices {
+		if seconds <= 0 || (conf.MaxLifetime > 0 && seconds > conf.MaxLifetime) {
+			return fmt.Errorf("paste lifetime %d is not between 1 and the maximum lifetime", seconds)
+		}
+	}
+
+	// Check retention rules
+	for _, rule := range conf.Retention {
+		if rule.MaxLifetime <= 0 || rule.MinSize < 0 {
+			return fmt.Errorf("retention rule %q needs a positive maximum lifetime and a minimum size of 0 or more", rule.Name)
+		}
+	}
+
+	// Check quota policy
+	if conf.QuotaPolicy != "reject" && conf.QuotaPolicy != "evict" {
+		return fmt.Errorf("unknown quota policy %q", conf.QuotaPolicy)
+	}
 
 	return nil
 }
+
+// Whether pastes may never expire.
+func (conf *Conf) allowNeverExpire() bool {
+	return conf.NeverExpire && conf.MaxLifetime == 0
+}
+
+// Check a paste lifetime, in seconds, 0 for pastes which never expire.
+// Returns an error message, or an empty string when the lifetime is allowed.
+func (conf *Conf) checkLifetime(seconds int) string {
+	if seconds == 0 {
+		if !conf.allowNeverExpire() {
+			return "Pastes must expire"
+		}
+		return ""
+	}
+	if conf.MaxLifetime > 0 && seconds > conf.MaxLifetime {
+		return fmt.Sprintf("Expiration delay is too long (%d seconds, max %d)", seconds, conf.MaxLifetime)
+	}
+	for _, allowed := range conf.ExpireChoices {
+		if seconds == allowed {
+			return ""
+		}
+	}
+	return fmt.Sprintf("Expiration delay %d is not allowed", seconds)
+}
@@ -1,9 +1,28 @@
 package bingo
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 )
 
+// Folder where unreadable files are moved, in the data folder.
+const lostFound = "lost+found"
+
+// Prefix of temporary files.
+const tempPrefix = ".tmp-"
+
+// Temporary files older than this are leftovers of interrupted writes.
+const staleTempAge = time.Hour
+
+// Names of the files and folders holding pastes.
+var regexName = regexp.MustCompile("^[A-Za-z0-9]+$")
+
 // setupFolder creates a folder (including subfolders) if it does not exist already.
 func setupFolder(folder string, perm os.FileMode) error {
 	// Create folder if it does not exist yet
@@ -15,3 +34,229 @@ func setupFolder(folder string, perm os.FileMode) error {
 	}
 	return nil
 }
+
+/*
+A backend storing records as files in a folder hierarchy.
+
+ - root: data folder path
+ - depth: number of subfolders in data hierarchy
+*/
+type fileBackend struct {
+	root  string
+	depth int
+}
+
+// Compute the storage path of a key.
+// The first element of the key is split into depth two-characters subfolders.
+func (b *fileBackend) path(key string) string {
+	name, rest := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		name, rest = key[:i], key[i+1:]
+	}
+	if 2*b.depth >= len(name) {
+		panic(errors.New("depth too big"))
+	}
+	s := b.root
+	for i := 0; i < b.depth; i++ {
+		s = path.Join(s, name[2*i:2*(i+1)])
+	}
+	s = filepath.Clean(path.Join(s, name[2*b.depth:], rest))
+	Loggers.Trace.Printf("Computed %s storage path: %s", key, s)
+	return s
+}
+
+// Convert filesystem errors.
+func fileError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Read a file.
+func (b *fileBackend) get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(b.path(key))
+	return data, fileError(err)
+}
+
+// Write a new file, creating its folder if needed.
+func (b *fileBackend) create(key string, data []byte) error {
+	p := b.path(key)
+
+	if err := setupFolder(filepath.Dir(p), 0770); err != nil {
+		return err
+	}
+
+	return writeFile(p, data, 0640, true)
+}
+
+// Write a file, creating its folder if needed.
+func (b *fileBackend) put(key string, data []byte) error {
+	p := b.path(key)
+
+	if err := setupFolder(filepath.Dir(p), 0770); err != nil {
+		return err
+	}
+
+	return writeFile(p, data, 0640, false)
+}
+
+// Atomically write a file.
+// Data is written and synced to a temporary file in the same folder, which is
+// then renamed to its final path, so that readers never see a partial file.
+// When exclusive is set, the write fails with ErrExists if the file exists.
+func writeFile(p string, data []byte, perm os.FileMode, exclusive bool) error {
+	dir := filepath.Dir(p)
+
+	f, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+
+	if exclusive {
+		// Linking fails if the destination exists
+		if err := os.Link(tmp, p); err != nil {
+			if os.IsExist(err) {
+				return ErrExists
+			}
+			return err
+		}
+	} else {
+		if err := os.Rename(tmp, p); err != nil {
+			return err
+		}
+	}
+
+	return syncFolder(dir)
+}
+
+// Sync a folder so that entries created or renamed in it are persisted.
+func syncFolder(folder string) error {
+	d, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Delete a file or a folder.
+func (b *fileBackend) remove(key string) error {
+	p := b.path(key)
+	if _, err := os.Lstat(p); err != nil {
+		return fileError(err)
+	}
+	return os.RemoveAll(p)
+}
+
+// List the files of a folder.
+func (b *fileBackend) list(name string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(b.path(name), "*"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(matches))
+	for _, match := range matches {
+		// Skip temporary files
+		if name := filepath.Base(match); !strings.HasPrefix(name, tempPrefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Call fn with the key of every file in the folder hierarchy.
+func (b *fileBackend) walk(fn func(key string) error) error {
+	return walkFolder(b.root, "", func(key, p string) error {
+		return fn(key)
+	})
+}
+
+// Scan a folder for keys, whatever the folder hierarchy depth.
+// fn is called with the key and the path of every file.
+// This function is called recursively when a subfolder is encountered.
+// prefix keeps track of the folder hierarchy to rebuild keys.
+// Stale temporary files left by interrupted writes are removed.
+func walkFolder(folder, prefix string, fn func(key, p string) error) error {
+	matches, err := filepath.Glob(filepath.Join(folder, "*"))
+	if err != nil {
+		return err
+	}
+
+	for _, match := range matches {
+		name := filepath.Base(match)
+
+		stat, e := os.Lstat(match)
+		if e != nil {
+			Loggers.Warn.Printf("Cannot stat %s: %s", match, e)
+			continue
+		}
+
+		if strings.HasPrefix(name, tempPrefix) {
+			if time.Since(stat.ModTime()) > staleTempAge {
+				Loggers.Warn.Printf("Remove stale temporary file %s", match)
+				os.Remove(match)
+			}
+			continue
+		}
+
+		// Skip discussion folders (ending with _), lost+found and other files
+		if !regexName.MatchString(name) {
+			continue
+		}
+
+		if stat.IsDir() {
+			// Recursively scan folder
+			if e := walkFolder(match, prefix+name, fn); e != nil {
+				return e
+			}
+		}
+
+		if stat.Mode().IsRegular() {
+			if e := fn(prefix+name, match); e != nil {
+				return e
+			}
+		}
+	}
+
+	return nil
+}
+
+// Move a file to the lost+found folder.
+func (b *fileBackend) quarantine(key string) error {
+	return quarantineFile(b.root, b.path(key), key)
+}
+
+// Move a file to the lost+found folder of a data folder.
+// The file is renamed after key and the current date so that nothing is overwritten.
+func quarantineFile(root, p, key string) error {
+	lost := filepath.Join(root, lostFound)
+	if err := setupFolder(lost, 0750); err != nil {
+		return err
+	}
+	dest := filepath.Join(lost, strings.Replace(key, "/", "-", -1)+"."+time.Now().Format("20060102150405.000000000"))
+	Loggers.Warn.Printf("Quarantine %s to %s", p, dest)
+	if err := os.Rename(p, dest); os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
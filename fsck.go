@@ -0,0 +1,443 @@
+package bingo
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Suffixes of the files and folders related to a paste file.
+var relatedSuffixes = []string{blobSuffix, "_", "~", "-"}
+
+/*
+Report of a data folder check.
+
+ - Pastes: number of checked pastes
+ - Unreadable: number of unreadable pastes, comments, revisions or attachments
+ - Mismatched: number of pastes whose id does not match their path
+ - Orphans: number of files related to a missing paste (eg. discussion folders)
+ - MissingParents: number of comments replying to a missing comment
+ - Expired: number of expired pastes
+ - Repaired: number of repaired problems
+ - Failed: number of problems which could not be repaired
+*/
+type FsckReport struct {
+	Pastes         int
+	Unreadable     int
+	Mismatched     int
+	Orphans        int
+	MissingParents int
+	Expired        int
+	Repaired       int
+	Failed         int
+}
+
+// Total number of problems found.
+func (r *FsckReport) problems() int {
+	return r.Unreadable + r.Mismatched + r.Orphans + r.MissingParents + r.Expired
+}
+
+// An entry of the data folder: a paste file, or a file or folder related to it.
+type fsckEntry struct {
+	key    string
+	suffix string
+	p      string
+}
+
+/*
+State of a data folder check.
+
+ - s: store of the data folder, used to decode and encode records
+ - root: data folder path
+ - repair: whether to repair problems
+ - w: problems are reported to w
+ - report: problem counts
+*/
+type fsck struct {
+	s      *recordStore
+	root   string
+	repair bool
+	w      io.Writer
+	report FsckReport
+	err    error
+}
+
+// Fsck checks the data folder of the configuration and reports unreadable
+// records, pastes whose id does not match their path, files related to
+// missing pastes, comments replying to missing comments and expired pastes.
+//
+// With repair set, misplaced pastes are moved to their path, unreadable and
+// orphaned files are moved to lost+found, replies to missing comments become
+// top-level comments and expired pastes are deleted.
+// The server must be stopped while the data folder is checked.
+func Fsck(file string, repair bool, w io.Writer) (FsckReport, error) {
+	if err := setup(file); err != nil {
+		return FsckReport{}, err
+	}
+	if conf.Storage != "files" {
+		return FsckReport{}, fmt.Errorf("storage %q has no data folder to check", conf.Storage)
+	}
+	s, err := openStore()
+	if err != nil {
+		return FsckReport{}, err
+	}
+
+	report, err := fsckFolder(s.(*recordStore), repair, w)
+	if err != nil {
+		return report, err
+	}
+
+	fmt.Fprintf(w, "%d pastes checked, %d problems found", report.Pastes, report.problems())
+	if repair {
+		fmt.Fprintf(w, ", %d repaired, %d failed", report.Repaired, report.Failed)
+	}
+	fmt.Fprintln(w)
+	return report, nil
+}
+
+// Check the data folder of a file store.
+// Pastes are first moved to their path, then their content is checked.
+func fsckFolder(s *recordStore, repair bool, w io.Writer) (FsckReport, error) {
+	f := &fsck{s: s, root: s.b.(*fileBackend).root, repair: repair, w: w}
+
+	pastes, _, err := f.scan(f.root, "")
+	if err != nil {
+		return f.report, err
+	}
+	for _, e := range pastes {
+		f.checkPath(e)
+		if f.err != nil {
+			return f.report, f.err
+		}
+	}
+
+	// Scan again, pastes may have moved
+	pastes, related, err := f.scan(f.root, "")
+	if err != nil {
+		return f.report, err
+	}
+	found := make(map[string]bool)
+	for _, e := range pastes {
+		found[e.p] = true
+		f.report.Pastes++
+		f.checkPaste(e)
+		if f.err != nil {
+			return f.report, f.err
+		}
+	}
+	for _, e := range related {
+		if !found[strings.TrimSuffix(e.p, e.suffix)] {
+			f.problem(&f.report.Orphans, e.p, "belongs to missing paste "+e.key, f.quarantine(e))
+		}
+	}
+	return f.report, nil
+}
+
+// Report a problem, and repair it in repair mode.
+func (f *fsck) problem(count *int, p, message string, repair func() error) {
+	*count++
+	if !f.repair || repair == nil {
+		fmt.Fprintf(f.w, "%s: %s\n", p, message)
+		return
+	}
+	if err := repair(); err != nil {
+		fmt.Fprintf(f.w, "%s: %s, cannot repair: %s\n", p, message, err)
+		f.report.Failed++
+		return
+	}
+	fmt.Fprintf(f.w, "%s: %s, repaired\n", p, message)
+	f.report.Repaired++
+}
+
+// Report an unreadable file, and repair it in repair mode.
+// Files which cannot be read with the current configuration (eg. without
+// their encryption key) are not corrupt: the check is aborted instead.
+func (f *fsck) unreadable(p, what string, err error, repair func() error) {
+	if isConfigError(err) {
+		f.err = fmt.Errorf("cannot read %s: %s", p, err)
+		return
+	}
+	f.problem(&f.report.Unreadable, p, fmt.Sprintf("unreadable %s: %s", what, err), repair)
+}
+
+// Repair function moving an entry to lost+found.
+func (f *fsck) quarantine(e fsckEntry) func() error {
+	return func() error {
+		return quarantineFile(f.root, e.p, e.key+e.suffix)
+	}
+}
+
+// Scan a folder for paste files and related files.
+// Unknown files are reported.
+func (f *fsck) scan(folder, prefix string) ([]fsckEntry, []fsckEntry, error) {
+	pastes := make([]fsckEntry, 0)
+	related := make([]fsckEntry, 0)
+
+	matches, err := filepath.Glob(filepath.Join(folder, "*"))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, match := range matches {
+		name := filepath.Base(match)
+		stat, err := os.Lstat(match)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if strings.HasPrefix(name, tempPrefix) || (folder == f.root && (name == lostFound || name == snapshotFolder || name == snapshotFile || name == tokenKeyFile || name == holdLockFile)) {
+			continue
+		}
+
+		if regexName.MatchString(name) {
+			if stat.IsDir() {
+				p, r, err := f.scan(match, prefix+name)
+				if err != nil {
+					return nil, nil, err
+				}
+				pastes, related = append(pastes, p...), append(related, r...)
+			} else if stat.Mode().IsRegular() {
+				pastes = append(pastes, fsckEntry{key: prefix + name, p: match})
+			}
+			continue
+		}
+
+		known := false
+		for _, suffix := range relatedSuffixes {
+			if trimmed := strings.TrimSuffix(name, suffix); trimmed != name && regexName.MatchString(trimmed) {
+				related = append(related, fsckEntry{key: prefix + trimmed, suffix: suffix, p: match})
+				known = true
+				break
+			}
+		}
+		if !known {
+			fmt.Fprintf(f.w, "%s: unknown file, skipped\n", match)
+		}
+	}
+	return pastes, related, nil
+}
+
+// Read the metadata record of a paste file.
+func (f *fsck) readRecord(e fsckEntry) (pasteRecord, error) {
+	data, err := ioutil.ReadFile(e.p)
+	if err != nil {
+		return pasteRecord{}, err
+	}
+	return f.s.decodeRecord(e.key, data)
+}
+
+// Check that a paste is stored at the path of its id.
+func (f *fsck) checkPath(e fsckEntry) {
+	rec, err := f.readRecord(e)
+	if err != nil {
+		f.unreadable(e.p, "paste", err, f.quarantine(e))
+		return
+	}
+
+	id := rec.Paste.Id
+	b := f.s.b.(*fileBackend)
+	if !regexName.MatchString(id) || 2*b.depth >= len(id) {
+		f.problem(&f.report.Mismatched, e.p, fmt.Sprintf("invalid paste id %q", id), f.quarantine(e))
+		return
+	}
+
+	dest := b.path(id)
+	if dest == e.p {
+		return
+	}
+
+	message := fmt.Sprintf("paste %s is stored at the path of %s", id, e.key)
+	if id == e.key {
+		message = fmt.Sprintf("paste %s is not stored at depth %d", id, b.depth)
+	}
+	f.problem(&f.report.Mismatched, e.p, message, func() error {
+		if _, err := os.Lstat(dest); err == nil {
+			// Keep the paste already stored at this path
+			return quarantineFile(f.root, e.p, e.key)
+		}
+		return movePaste(e.p, dest)
+	})
+}
+
+// Check the content of a paste: expiration, data, comments, revisions and attachments.
+func (f *fsck) checkPaste(e fsckEntry) {
+	rec, err := f.readRecord(e)
+	if err != nil {
+		// Reported while checking paths, unless repaired
+		return
+	}
+	paste := rec.Paste
+
+	// Pastes in the trash expire at the end of their grace period, pastes
+	// under legal hold never do
+	if paste.Hold == nil && expiresBefore(paste.cleanDate(), time.Now()) {
+		f.problem(&f.report.Expired, e.p, fmt.Sprintf("paste expired on %s", paste.cleanDate()), func() error {
+			for _, suffix := range relatedSuffixes {
+				if err := os.RemoveAll(e.p + suffix); err != nil {
+					return err
+				}
+			}
+			return os.Remove(e.p)
+		})
+		return
+	}
+
+	// Paste data
+	if rec.Schema == pasteSchema {
+		blob, err := ioutil.ReadFile(e.p + blobSuffix)
+		if err == nil {
+			blob, err = f.s.unpackBlob(&rec, blob)
+		}
+		if err == nil {
+			_, err = rec.decodeBlob(blob)
+		}
+		if err != nil {
+			f.unreadable(e.p, "paste data", err, func() error {
+				if err := quarantineFile(f.root, e.p+blobSuffix, e.key+blobSuffix); err != nil && err != ErrNotFound {
+					return err
+				}
+				return quarantineFile(f.root, e.p, e.key)
+			})
+			return
+		}
+	}
+
+	f.checkComments(e)
+	f.checkRevisions(e)
+	f.checkAttachments(e, paste)
+}
+
+// Check the comments of a paste.
+func (f *fsck) checkComments(e fsckEntry) {
+	folder := e.p + "_"
+	files, _ := filepath.Glob(filepath.Join(folder, "*"))
+
+	comments := make(map[string]Comment)
+	paths := make(map[string]string)
+	for _, p := range files {
+		id := filepath.Base(p)
+		if strings.HasPrefix(id, tempPrefix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(p)
+		comment := Comment{Id: id}
+		if err == nil {
+			err = f.s.decode(commentKey(e.key, id), data, &comment)
+		}
+		if err != nil {
+			f.unreadable(p, "comment", err, func() error {
+				return quarantineFile(f.root, p, commentKey(e.key, id))
+			})
+			continue
+		}
+		comments[id] = comment
+		paths[id] = p
+	}
+
+	for id, comment := range comments {
+		if comment.Parent == "" {
+			continue
+		}
+		if _, ok := comments[comment.Parent]; ok {
+			continue
+		}
+		comment, p, key := comment, paths[id], commentKey(e.key, id)
+		f.problem(&f.report.MissingParents, p, fmt.Sprintf("comment replies to missing comment %s", comment.Parent), func() error {
+			comment.Parent = ""
+			data, err := f.s.encode(key, comment)
+			if err != nil {
+				return err
+			}
+			return writeFile(p, data, 0640, false)
+		})
+	}
+}
+
+// Check the revisions of a paste.
+func (f *fsck) checkRevisions(e fsckEntry) {
+	files, _ := filepath.Glob(filepath.Join(e.p+"~", "*"))
+	for _, p := range files {
+		name := filepath.Base(p)
+		if strings.HasPrefix(name, tempPrefix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(p)
+		var rev Revision
+		if err == nil {
+			err = f.s.decode(revisionsKey(e.key)+"/"+name, data, &rev)
+		}
+		if err != nil {
+			f.unreadable(p, "revision", err, func() error {
+				return quarantineFile(f.root, p, revisionsKey(e.key)+"/"+name)
+			})
+		}
+	}
+}
+
+// Check the attachments of a paste.
+func (f *fsck) checkAttachments(e fsckEntry, paste *Paste) {
+	files, _ := filepath.Glob(filepath.Join(e.p+"-", "*"))
+	stored := make(map[string]bool)
+	for _, p := range files {
+		id := filepath.Base(p)
+		if strings.HasPrefix(id, tempPrefix) {
+			continue
+		}
+		stored[id] = true
+		if _, ok := paste.attachment(id); !ok {
+			f.problem(&f.report.Orphans, p, "attachment is not listed by its paste", func() error {
+				return quarantineFile(f.root, p, attachmentKey(e.key, id))
+			})
+			continue
+		}
+		data, err := ioutil.ReadFile(p)
+		if err == nil {
+			data, err = f.s.unpack(attachmentKey(e.key, id), data)
+		}
+		if err == nil {
+			_, err = decodeAttachment(data)
+		}
+		if err != nil {
+			f.unreadable(p, "attachment", err, func() error {
+				if err := quarantineFile(f.root, p, attachmentKey(e.key, id)); err != nil {
+					return err
+				}
+				return f.dropAttachment(e, id)
+			})
+		}
+	}
+
+	for _, a := range paste.Attachments {
+		if stored[a.Id] {
+			continue
+		}
+		id := a.Id
+		f.problem(&f.report.Unreadable, e.p, fmt.Sprintf("data of attachment %s is missing", id), func() error {
+			return f.dropAttachment(e, id)
+		})
+	}
+}
+
+// Remove an attachment from the metadata record of a paste.
+func (f *fsck) dropAttachment(e fsckEntry, id string) error {
+	rec, err := f.readRecord(e)
+	if err != nil {
+		return err
+	}
+	attachments := make([]Attachment, 0, len(rec.Paste.Attachments))
+	for _, a := range rec.Paste.Attachments {
+		if a.Id != id {
+			attachments = append(attachments, a)
+		}
+	}
+	rec.Paste.Attachments = attachments
+
+	data, err := f.s.encode(e.key, rec)
+	if err != nil {
+		return err
+	}
+	return writeFile(e.p, data, 0640, false)
+}
@@ -0,0 +1,105 @@
+package bingo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFsck(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+
+	s := newFileStore(root, 2)
+	b := s.b.(*fileBackend)
+	create := func(paste *Paste) {
+		if paste.Expire.IsZero() {
+			paste.Expire = time.Now().Add(time.Hour)
+		}
+		if err := s.CreatePaste(paste); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A paste with a reply to a deleted comment
+	good := newPaste("Awesome paste")
+	good.Discussion = true
+	create(&good)
+	parent := newComment("Comment", nil)
+	reply := newComment("Reply", &parent)
+	if err := s.AppendComment(&good, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// A paste stored at the wrong depth
+	misplaced := newPaste("Misplaced paste")
+	create(&misplaced)
+	if err := movePaste(b.path(misplaced.Id), (&fileBackend{root: root, depth: 1}).path(misplaced.Id)); err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired paste
+	expired := newPaste("Expired paste")
+	expired.Expire = time.Now().Add(-time.Hour)
+	create(&expired)
+
+	// An unreadable paste
+	unreadable := newPaste("Unreadable paste")
+	create(&unreadable)
+	if err := ioutil.WriteFile(b.path(unreadable.Id), []byte("not json"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// A discussion folder left by a deleted paste
+	orphan := newId()
+	if err := os.MkdirAll(filepath.Join(filepath.Dir(b.path(orphan)), filepath.Base(b.path(orphan))+"_"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check only
+	report, err := fsckFolder(s, false, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FsckReport{Pastes: 4, Unreadable: 1, Mismatched: 1, Orphans: 1, MissingParents: 1, Expired: 1}
+	if report != want {
+		t.Errorf("fsckFolder() == %+v, want %+v", report, want)
+	}
+	if _, err := s.GetPaste(misplaced.Id); err != ErrNotFound {
+		t.Errorf("paste %s was moved without repair", misplaced.Id)
+	}
+
+	// Repair
+	report, err = fsckFolder(s, true, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 0 || report.Repaired != report.problems() {
+		t.Errorf("fsckFolder() repair == %+v, want all problems repaired", report)
+	}
+
+	if _, err := s.GetPaste(misplaced.Id); err != nil {
+		t.Errorf("GetPaste(%q) after repair error: %s", misplaced.Id, err)
+	}
+	if _, err := s.GetPaste(expired.Id); err != ErrNotFound {
+		t.Errorf("GetPaste(%q) of an expired paste after repair error == %v, want %v", expired.Id, err, ErrNotFound)
+	}
+	if comments, err := s.ListComments(&good); err != nil || len(comments) != 1 || comments[0].Parent != "" {
+		t.Errorf("ListComments() after repair == %+v, %v, want a top-level comment", comments, err)
+	}
+	// The unreadable paste and its blob, orphaned once the paste is moved
+	if lost, _ := filepath.Glob(filepath.Join(root, lostFound, unreadable.Id+".*")); len(lost) != 2 {
+		t.Errorf("%s holds %v, want the unreadable paste and its blob", lostFound, lost)
+	}
+
+	// Nothing left to repair
+	report, err = fsckFolder(s, false, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.problems() != 0 || report.Pastes != 2 {
+		t.Errorf("fsckFolder() after repair == %+v, want 2 pastes and no problem", report)
+	}
+}
@@ -0,0 +1,134 @@
+package bingo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Name of the file locked while legal holds change, in the data folder.
+const holdLockFile = "hold.lock"
+
+// PlaceHold places a legal hold on a paste of the store: the paste is then
+// kept past its expiration date and its view limit, and delete requests are
+// refused, until the hold is released. Pastes in the trash can be held too.
+// The hold replaces any previous hold of the paste.
+// With the files storage, holds can change while servers of the same host
+// run: see lockHolds. The journal storage cannot be opened while the server
+// runs, and servers sharing an s3 bucket must be stopped while holds change.
+func PlaceHold(file, id, reason string) error {
+	if err := openConfStore(file); err != nil {
+		return err
+	}
+	return placeHold(id, reason)
+}
+
+// ReleaseHold releases the legal hold of a paste of the store, which then
+// expires and can be deleted again.
+// See PlaceHold for the storages allowing it while the server runs.
+func ReleaseHold(file, id string) error {
+	if err := openConfStore(file); err != nil {
+		return err
+	}
+	return releaseHold(id)
+}
+
+// ListHolds returns the pastes of the store under legal hold, without their
+// data, sorted by hold date.
+func ListHolds(file string) ([]Paste, error) {
+	if err := openConfStore(file); err != nil {
+		return nil, err
+	}
+	return listHolds()
+}
+
+// pastesByHoldDate implements sort.Interface for []Paste under legal hold based on the hold date.
+type pastesByHoldDate []Paste
+
+func (a pastesByHoldDate) Len() int           { return len(a) }
+func (a pastesByHoldDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a pastesByHoldDate) Less(i, j int) bool { return a[i].Hold.Date.Before(a[j].Hold.Date) }
+
+// Load a configuration file and open its store.
+func openConfStore(file string) error {
+	if err := setup(file); err != nil {
+		return err
+	}
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	store = s
+	return nil
+}
+
+// Lock the records of a files storage against legal hold changes by other
+// processes: hold changes are exclusive, and writes of pastes read their hold
+// again under a shared lock. Unlocked by calling the returned function.
+// Other storages are not locked.
+func (s *recordStore) lockHolds(exclusive bool) (func(), error) {
+	b, ok := s.b.(*fileBackend)
+	if !ok {
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(filepath.Join(b.root, holdLockFile), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Closing the file releases the lock
+	return func() { f.Close() }, nil
+}
+
+// Place a legal hold on a paste.
+func placeHold(id, reason string) error {
+	previous, err := store.SetHold(id, &Hold{Date: time.Now(), Reason: reason})
+	if err == ErrNotFound {
+		return fmt.Errorf("paste %s not found", id)
+	} else if err != nil {
+		return err
+	}
+	if previous != nil {
+		Loggers.Warn.Printf("Legal hold of paste %s placed on %s replaced", id, previous.Date)
+	}
+	Loggers.Info.Printf("Legal hold placed on paste %s: %s", id, reason)
+	return nil
+}
+
+// Release the legal hold of a paste.
+func releaseHold(id string) error {
+	previous, err := store.SetHold(id, nil)
+	if err == ErrNotFound {
+		return fmt.Errorf("paste %s not found", id)
+	} else if err != nil {
+		return err
+	}
+	if previous == nil {
+		return fmt.Errorf("paste %s is not under legal hold", id)
+	}
+	Loggers.Info.Printf("Legal hold of paste %s released", id)
+	return nil
+}
+
+// Load the pastes under legal hold, sorted by hold date.
+func listHolds() ([]Paste, error) {
+	held := make([]Paste, 0)
+	err := store.WalkMeta(func(paste *Paste, size int64) error {
+		if paste.Hold != nil {
+			held = append(held, *paste)
+		}
+		return nil
+	})
+	sort.Sort(pastesByHoldDate(held))
+	return held, err
+}
@@ -0,0 +1,179 @@
+package bingo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHold(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	initPatterns()
+	conf.Views = "resources/views"
+	initTemplates()
+
+	antiflood.m = make(map[string]time.Time)
+	var created Postresponse
+	if err := json.Unmarshal(post(`{"data":"Paste","expire":3600}`).Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if err := placeHold(created.Id, "Case 42"); err != nil {
+		t.Fatal(err)
+	}
+	if err := placeHold(newId(), "Case 42"); err == nil {
+		t.Errorf("placeHold() of an unknown paste succeeded")
+	}
+
+	// Delete requests are refused
+	w := request(handlerRoot, "GET", "/delete/"+created.Id+"/"+created.Delete, "")
+	if w.Code != http.StatusLocked || !strings.Contains(w.Body.String(), "legal hold") {
+		t.Errorf("GET /delete/%s of a held paste == %d %q, want a legal hold error", created.Id, w.Code, w.Body.String())
+	}
+	r := httptest.NewRequest("GET", "/delete/"+created.Id+"/"+created.Delete, nil)
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	handlerRoot(w, r)
+	var e ErrorResponse
+	if w.Code != http.StatusLocked || json.Unmarshal(w.Body.Bytes(), &e) != nil || e.Code != http.StatusLocked {
+		t.Errorf("GET /delete/%s of a held paste accepting json == %d %q, want a json legal hold error", created.Id, w.Code, w.Body.String())
+	}
+	if _, err := store.GetPaste(created.Id); err != nil {
+		t.Errorf("GetPaste(%q) after delete error: %s", created.Id, err)
+	}
+
+	// Saving a copy loaded before the hold keeps it
+	stale, err := store.GetPaste(created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Hold = nil
+	if err := store.PutPaste(&stale); err != nil {
+		t.Fatal(err)
+	}
+	s := store.(*recordStore)
+	if err := s.putPaste(&stale); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := store.GetPaste(created.Id); err != nil || p.Hold == nil || p.Hold.Reason != "Case 42" {
+		t.Errorf("GetPaste(%q) after saving a stale copy == %+v, %v, want the hold kept", created.Id, p, err)
+	}
+
+	// Readers are not told about holds
+	if w := request(handlerRoot, "GET", "/"+created.Id, ""); strings.Contains(w.Body.String(), "Case 42") {
+		t.Errorf("GET /%s discloses the legal hold", created.Id)
+	}
+
+	// Expired and burned pastes are kept
+	expired := newPaste("Expired paste")
+	expired.Expire = time.Now().Add(-time.Minute)
+	if err := createPaste(&expired); err != nil {
+		t.Fatal(err)
+	}
+	antiflood.m = make(map[string]time.Time)
+	var burn Postresponse
+	if err := json.Unmarshal(post(`{"data":"Secret","expire":3600,"burn":true}`).Body.Bytes(), &burn); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{expired.Id, burn.Id} {
+		if err := placeHold(id, "Case 43"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleteExpiredPastes()
+	if w := request(handlerReveal, "POST", "/reveal/"+burn.Id, ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Case 43") {
+		t.Errorf("POST /reveal/%s of a held paste == %d %q, want the paste without its hold", burn.Id, w.Code, w.Body.String())
+	}
+	if w := request(handlerReveal, "POST", "/reveal/"+burn.Id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("POST /reveal/%s of a held paste read once status == %d, want %d", burn.Id, w.Code, http.StatusNotFound)
+	}
+	for _, id := range []string{expired.Id, burn.Id} {
+		if _, err := store.GetPaste(id); err != nil {
+			t.Errorf("GetPaste(%q) of a held paste error: %s", id, err)
+		}
+		if _, ok := index.ids[id]; !ok {
+			t.Errorf("held paste %s is not indexed", id)
+		}
+	}
+
+	// Pastes in the trash are kept as well
+	conf.TrashGrace = 3600
+	trashed, err := trashPaste(created.Id)
+	if err != ErrHeld {
+		t.Errorf("trashPaste() of a held paste error == %v, want %v", err, ErrHeld)
+	}
+	if err := releaseHold(created.Id); err != nil {
+		t.Fatal(err)
+	}
+	if trashed, err = trashPaste(created.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := placeHold(created.Id, "Case 44"); err != nil {
+		t.Fatal(err)
+	}
+	indexTrash(created.Id, true, time.Now().Add(-time.Minute))
+	deleteExpiredPastes()
+	if _, err := store.GetTrash(created.Id); err != nil {
+		t.Errorf("GetTrash(%q) of a held paste error: %s", created.Id, err)
+	}
+
+	held, err := listHolds()
+	if err != nil || len(held) != 3 || held[2].Id != created.Id || held[2].Hold.Reason != "Case 44" || held[2].Trashed.IsZero() {
+		t.Errorf("listHolds() == %+v, %v, want 3 pastes, %s last and in the trash", held, err, trashed.Id)
+	}
+
+	// Released pastes are deleted again, at once when their views were used up
+	if err := releaseHold(burn.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.GetMeta(burn.Id); err != ErrNotFound {
+		t.Errorf("GetMeta(%q) of a released paste read once error == %v, want %v", burn.Id, err, ErrNotFound)
+	}
+	if err := releaseHold(expired.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := releaseHold(expired.Id); err == nil {
+		t.Errorf("releaseHold() of a paste not held succeeded")
+	}
+	indexExpire(expired.Id, time.Now().Add(-time.Minute))
+	deleteExpiredPastes()
+	if _, err := store.GetPaste(expired.Id); err != ErrNotFound {
+		t.Errorf("GetPaste(%q) of a released expired paste error == %v, want %v", expired.Id, err, ErrNotFound)
+	}
+}
+
+func TestHoldLock(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+
+	s := newFileStore(root, 2)
+	paste := newPaste("Awesome paste")
+	paste.MaxViews = 2
+	if err := s.CreatePaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes of the server wait for hold changes of other processes
+	unlock, err := s.lockHolds(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := s.ViewPaste(paste.Id)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatalf("ViewPaste() did not wait for the hold lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Errorf("ViewPaste() error: %s", err)
+	}
+}
@@ -0,0 +1,76 @@
+package bingo
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Named id alphabets.
+var idAlphabets = map[string]string{
+	"hex":    "0123456789abcdef",
+	"base62": "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+}
+
+// Ids generated before random ids were introduced are 20 hexadecimal characters.
+const legacyIdPattern = "[0-9a-f]{20}"
+
+// Number of attempts to find an unused id before giving up.
+const idAttempts = 5
+
+// Validates custom id alphabets (ids are used in URLs and storage paths).
+var regexIdAlphabet = regexp.MustCompile("^[A-Za-z0-9]+$")
+
+// Resolve an id alphabet, which is either a named alphabet or a list of characters.
+func resolveIdAlphabet(alphabet string) (string, error) {
+	if named, ok := idAlphabets[alphabet]; ok {
+		return named, nil
+	}
+	if !regexIdAlphabet.MatchString(alphabet) {
+		return "", fmt.Errorf("id alphabet %q must only contain letters and digits", alphabet)
+	}
+	for i := range alphabet {
+		if strings.IndexByte(alphabet, alphabet[i]) != i {
+			return "", fmt.Errorf("id alphabet %q contains duplicate characters", alphabet)
+		}
+	}
+	if len(alphabet) < 2 {
+		return "", errors.New("id alphabet must contain at least two characters")
+	}
+	return alphabet, nil
+}
+
+// Generate a random id from the configured alphabet and length.
+func newId() string {
+	alphabet, err := resolveIdAlphabet(conf.IdAlphabet)
+	if err != nil {
+		panic(err)
+	}
+
+	// Bytes above max are rejected so that all characters are equally likely
+	max := 256 - 256%len(alphabet)
+	id := make([]byte, 0, conf.IdLength)
+	buf := make([]byte, conf.IdLength)
+	for len(id) < conf.IdLength {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		for _, b := range buf {
+			if int(b) < max && len(id) < conf.IdLength {
+				id = append(id, alphabet[int(b)%len(alphabet)])
+			}
+		}
+	}
+	return string(id)
+}
+
+// Regular expression matching paste ids, including legacy ones.
+func idPattern() string {
+	alphabet, err := resolveIdAlphabet(conf.IdAlphabet)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("(?:[%s]{%d}|%s)", regexp.QuoteMeta(alphabet), conf.IdLength, legacyIdPattern)
+}
@@ -0,0 +1,463 @@
+package bingo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Journal record operations.
+const (
+	journalPut    byte = 1
+	journalRemove byte = 2
+)
+
+// Size of a journal record header: crc (4), operation (1), key length (2), data length (4).
+const journalHeaderSize = 11
+
+// Minimum amount of dead bytes before a journal gets compacted.
+const journalCompactMin = 1 << 20
+
+var errJournalCorrupted = errors.New("corrupted journal record")
+
+// Location of a record data in the journal file.
+type journalEntry struct {
+	offset int64
+	size   int64
+}
+
+/*
+A backend storing all records in a single append-only log file.
+
+Every put or remove appends a record to the file. An in-memory index maps
+each live key to the offset of its data, and the file is periodically
+compacted to drop overwritten and removed records.
+
+ - path: journal file path
+ - lock: lock file, locked while the journal is open
+ - f: journal file
+ - size: journal file size
+ - dead: number of bytes used by overwritten or removed records
+ - m: live records index
+ - dirs: names of the records stored below each name
+*/
+type journalBackend struct {
+	sync.RWMutex
+	path string
+	lock *os.File
+	f    *os.File
+	size int64
+	dead int64
+	m    map[string]journalEntry
+	dirs map[string]map[string]bool
+}
+
+// Open a journal file, creating it if needed, and build its index.
+// A journal can only be opened by one process at a time: the others would
+// not see its writes, and compaction would drop them.
+func openJournal(path string) (*journalBackend, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("journal %s is already open by another process, stop the server first", path)
+		}
+		return nil, err
+	}
+
+	b := &journalBackend{path: path, lock: lock}
+	if err := b.open(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close the journal file and release its lock.
+func (b *journalBackend) close() error {
+	b.Lock()
+	defer b.Unlock()
+	err := b.f.Close()
+	if lerr := b.lock.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// Open the journal file and replay it to build the index.
+func (b *journalBackend) open() error {
+	f, err := os.OpenFile(b.path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	b.f = f
+	b.size = 0
+	b.dead = 0
+	b.m = make(map[string]journalEntry)
+	b.dirs = make(map[string]map[string]bool)
+
+	r := bufio.NewReader(f)
+	for {
+		op, key, data, n, err := readJournalRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Torn write at the end of the journal, move it aside
+			Loggers.Warn.Printf("Journal %s: %s at offset %d, truncate", b.path, err, b.size)
+			if err := b.saveTail(); err != nil {
+				return err
+			}
+			if err := f.Truncate(b.size); err != nil {
+				return err
+			}
+			break
+		}
+		b.apply(op, key, journalEntry{b.size + n - int64(len(data)), int64(len(data))}, n)
+		b.size += n
+	}
+
+	Loggers.Info.Printf("Journal %s opened with %d records", b.path, len(b.m))
+	return nil
+}
+
+// Save the journal content after the last valid record to the lost+found folder.
+func (b *journalBackend) saveTail() error {
+	tail, err := ioutil.ReadAll(io.NewSectionReader(b.f, b.size, 1<<62))
+	if err != nil {
+		return err
+	}
+	return b.lost(filepath.Base(b.path)+".tail", tail)
+}
+
+// Write data to a new file of the lost+found folder next to the journal file.
+func (b *journalBackend) lost(name string, data []byte) error {
+	lost := filepath.Join(filepath.Dir(b.path), lostFound)
+	if err := setupFolder(lost, 0750); err != nil {
+		return err
+	}
+	p := filepath.Join(lost, strings.Replace(name, "/", "-", -1)+"."+time.Now().Format("20060102150405.000000000"))
+	Loggers.Warn.Printf("Save unreadable journal data to %s", p)
+	return writeFile(p, data, 0640, true)
+}
+
+// Read a record from a journal.
+// Returns the record operation, key, data and total size.
+func readJournalRecord(r io.Reader) (byte, string, []byte, int64, error) {
+	header := make([]byte, journalHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return 0, "", nil, 0, err
+		}
+		return 0, "", nil, 0, errJournalCorrupted
+	}
+
+	op := header[4]
+	klen := int(binary.BigEndian.Uint16(header[5:7]))
+	dlen := int64(binary.BigEndian.Uint32(header[7:11]))
+
+	body := make([]byte, int64(klen)+dlen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, "", nil, 0, errJournalCorrupted
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+		return 0, "", nil, 0, errJournalCorrupted
+	}
+	if op != journalPut && op != journalRemove {
+		return 0, "", nil, 0, errJournalCorrupted
+	}
+
+	return op, string(body[:klen]), body[klen:], journalHeaderSize + int64(len(body)), nil
+}
+
+// Encode a journal record.
+func journalRecord(op byte, key string, data []byte) []byte {
+	record := make([]byte, journalHeaderSize+len(key)+len(data))
+	record[4] = op
+	binary.BigEndian.PutUint16(record[5:7], uint16(len(key)))
+	binary.BigEndian.PutUint32(record[7:11], uint32(len(data)))
+	copy(record[journalHeaderSize:], key)
+	copy(record[journalHeaderSize+len(key):], data)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// Split a key into its parent name and its base name.
+func splitKey(key string) (string, string) {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// Apply a record to the index.
+// n is the size of the record in the journal.
+func (b *journalBackend) apply(op byte, key string, e journalEntry, n int64) {
+	switch op {
+	case journalPut:
+		if old, ok := b.m[key]; ok {
+			b.dead += journalHeaderSize + int64(len(key)) + old.size
+		}
+		b.m[key] = e
+		dir, name := splitKey(key)
+		if dir != "" {
+			if b.dirs[dir] == nil {
+				b.dirs[dir] = make(map[string]bool)
+			}
+			b.dirs[dir][name] = true
+		}
+	case journalRemove:
+		// A remove record is dead as soon as it is written
+		b.dead += n
+		b.drop(key)
+	}
+}
+
+// Remove a key and everything stored below it from the index.
+func (b *journalBackend) drop(key string) {
+	if old, ok := b.m[key]; ok {
+		b.dead += journalHeaderSize + int64(len(key)) + old.size
+		delete(b.m, key)
+		dir, name := splitKey(key)
+		if names := b.dirs[dir]; names != nil {
+			delete(names, name)
+			if len(names) == 0 {
+				delete(b.dirs, dir)
+			}
+		}
+	}
+	for name := range b.dirs[key] {
+		b.drop(key + "/" + name)
+	}
+	delete(b.dirs, key)
+}
+
+// Append a record to the journal file.
+func (b *journalBackend) append(op byte, key string, data []byte) (journalEntry, int64, error) {
+	record := journalRecord(op, key, data)
+	if _, err := b.f.WriteAt(record, b.size); err != nil {
+		// Drop any partial write
+		b.f.Truncate(b.size)
+		return journalEntry{}, 0, err
+	}
+	if err := b.f.Sync(); err != nil {
+		return journalEntry{}, 0, err
+	}
+	n := int64(len(record))
+	e := journalEntry{b.size + n - int64(len(data)), int64(len(data))}
+	b.size += n
+	return e, n, nil
+}
+
+// Read a record.
+func (b *journalBackend) get(key string) ([]byte, error) {
+	b.RLock()
+	defer b.RUnlock()
+	e, ok := b.m[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	data := make([]byte, e.size)
+	if _, err := b.f.ReadAt(data, e.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Write a new record.
+func (b *journalBackend) create(key string, data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.m[key]; ok {
+		return ErrExists
+	}
+	return b.write(key, data)
+}
+
+// Write a record.
+func (b *journalBackend) put(key string, data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	return b.write(key, data)
+}
+
+// Append a put record and update the index.
+// Caller must hold the lock.
+func (b *journalBackend) write(key string, data []byte) error {
+	e, n, err := b.append(journalPut, key, data)
+	if err != nil {
+		return err
+	}
+	b.apply(journalPut, key, e, n)
+	return nil
+}
+
+// Delete a record and everything stored below it.
+func (b *journalBackend) remove(key string) error {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.m[key]; !ok && b.dirs[key] == nil {
+		return ErrNotFound
+	}
+	e, n, err := b.append(journalRemove, key, nil)
+	if err != nil {
+		return err
+	}
+	b.apply(journalRemove, key, e, n)
+	return nil
+}
+
+// List the records stored below a name.
+func (b *journalBackend) list(name string) ([]string, error) {
+	b.RLock()
+	defer b.RUnlock()
+	names := make([]string, 0, len(b.dirs[name]))
+	for n := range b.dirs[name] {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Call fn with the key of every top-level record.
+func (b *journalBackend) walk(fn func(key string) error) error {
+	b.RLock()
+	keys := make([]string, 0, len(b.m))
+	for k := range b.m {
+		if !strings.Contains(k, "/") {
+			keys = append(keys, k)
+		}
+	}
+	b.RUnlock()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move an unreadable record to the lost+found folder.
+func (b *journalBackend) quarantine(key string) error {
+	data, err := b.get(key)
+	if err != nil {
+		return err
+	}
+	if err := b.lost(key, data); err != nil {
+		return err
+	}
+	return b.remove(key)
+}
+
+// Check whether the journal has enough dead bytes to be compacted.
+func (b *journalBackend) needsCompaction() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.dead >= journalCompactMin && 2*b.dead >= b.size
+}
+
+// Rewrite the journal file with live records only.
+func (b *journalBackend) compact() error {
+	b.Lock()
+	defer b.Unlock()
+
+	Loggers.Info.Printf("Compact journal %s (%d bytes, %d dead)", b.path, b.size, b.dead)
+
+	tmp := b.path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(b.m))
+	for k := range b.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w := bufio.NewWriter(f)
+	for _, k := range keys {
+		e := b.m[k]
+		data := make([]byte, e.size)
+		if _, err := b.f.ReadAt(data, e.offset); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+		if _, err := w.Write(journalRecord(journalPut, k, data)); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Swap journal files
+	if err := os.Rename(tmp, b.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	b.f.Close()
+
+	return b.open()
+}
+
+// Start the journal compaction daemon if the store is a journal.
+// Only the server compacts the journal, commands exit before it is needed.
+func startCompactDaemon() {
+	if s, ok := store.(*recordStore); ok {
+		if b, ok := s.b.(*journalBackend); ok {
+			b.startCompactDaemon(conf.CompactThreshold)
+		}
+	}
+}
+
+// Start the journal compaction daemon.
+func (b *journalBackend) startCompactDaemon(threshold int) {
+	Loggers.Info.Printf("Start journal compaction daemon with a %d seconds threshold", threshold)
+	tick := time.NewTicker(time.Duration(threshold) * time.Second).C
+	go func() {
+		for _ = range tick {
+			if !b.needsCompaction() {
+				continue
+			}
+			if err := b.compact(); err != nil {
+				Loggers.Error.Printf("Cannot compact journal %s: %s", b.path, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,75 @@
+package bingo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalStore(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+
+	b, err := openJournal(filepath.Join(root, "bingo.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, &recordStore{b: b})
+}
+
+func TestJournalReplay(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "bingo.journal")
+
+	b, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.put("a", []byte("first"))
+	b.put("a", []byte("second"))
+	b.put("b", []byte("deleted"))
+	b.put("b_/c", []byte("comment"))
+	b.remove("b")
+	b.remove("b_")
+	b.put("c", []byte("torn"))
+	size := b.size
+	b.close()
+
+	// Simulate a torn write of the last record
+	if err := os.Truncate(path, size-2); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+
+	// The journal cannot be opened twice
+	if _, err := openJournal(path); err == nil {
+		t.Errorf("openJournal() of an open journal succeeded")
+	}
+
+	if data, err := b.get("a"); err != nil || string(data) != "second" {
+		t.Errorf("get(\"a\") == %q, %v, want \"second\"", data, err)
+	}
+	for _, key := range []string{"b", "b_/c", "c"} {
+		if _, err := b.get(key); err != ErrNotFound {
+			t.Errorf("get(%q) error == %v, want %v", key, err, ErrNotFound)
+		}
+	}
+
+	// Compaction keeps live records only
+	before := b.size
+	if err := b.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if b.size >= before || b.dead != 0 {
+		t.Errorf("compact() size == %d, dead == %d, want size < %d and no dead bytes", b.size, b.dead, before)
+	}
+	if data, err := b.get("a"); err != nil || string(data) != "second" {
+		t.Errorf("get(\"a\") after compaction == %q, %v, want \"second\"", data, err)
+	}
+}
@@ -0,0 +1,109 @@
+package bingo
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A backend storing records in memory, mostly useful for tests.
+// RWMutex ensures safe concurrent access to the map.
+type memoryBackend struct {
+	sync.RWMutex
+	m map[string][]byte
+}
+
+// Create a new memory backend.
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{m: make(map[string][]byte)}
+}
+
+// Read a record.
+func (b *memoryBackend) get(key string) ([]byte, error) {
+	b.RLock()
+	defer b.RUnlock()
+	data, ok := b.m[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// Write a new record.
+func (b *memoryBackend) create(key string, data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.m[key]; ok {
+		return ErrExists
+	}
+	b.m[key] = append([]byte(nil), data...)
+	return nil
+}
+
+// Write a record.
+func (b *memoryBackend) put(key string, data []byte) error {
+	b.Lock()
+	b.m[key] = append([]byte(nil), data...)
+	b.Unlock()
+	return nil
+}
+
+// Delete a record and everything stored below it.
+func (b *memoryBackend) remove(key string) error {
+	b.Lock()
+	defer b.Unlock()
+	found := false
+	for k := range b.m {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(b.m, k)
+			found = true
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List the records stored below a name.
+func (b *memoryBackend) list(name string) ([]string, error) {
+	b.RLock()
+	defer b.RUnlock()
+	names := make([]string, 0)
+	for k := range b.m {
+		if strings.HasPrefix(k, name+"/") {
+			names = append(names, k[len(name)+1:])
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Call fn with the key of every top-level record.
+func (b *memoryBackend) walk(fn func(key string) error) error {
+	b.RLock()
+	keys := make([]string, 0, len(b.m))
+	for k := range b.m {
+		if !strings.Contains(k, "/") {
+			keys = append(keys, k)
+		}
+	}
+	b.RUnlock()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop an unreadable record, memory has no lost+found.
+func (b *memoryBackend) quarantine(key string) error {
+	Loggers.Warn.Printf("Drop unreadable record %s", key)
+	b.Lock()
+	delete(b.m, key)
+	b.Unlock()
+	return nil
+}
@@ -0,0 +1,183 @@
+package bingo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Report of a layout migration.
+
+ - Moved: number of pastes moved (or to move, on a dry run)
+ - InPlace: number of pastes already stored at the target depth
+ - Failed: number of pastes that could not be moved
+*/
+type MigrateReport struct {
+	Moved   int
+	InPlace int
+	Failed  int
+}
+
+// MigrateLayout moves the pastes of the data folder to a new depth.
+//
+// Pastes are found whatever their current depth, and each paste is moved
+// along with its related files and folders (eg. its discussion), the paste
+// file itself being moved last. Stopping the migration and running it again
+// is thus safe, and pastes already at the target depth are left untouched.
+// On a dry run, planned moves are only reported.
+// The configuration depth must be updated once the migration is over.
+func MigrateLayout(file string, depth int, dryRun bool, w io.Writer) error {
+	if err := setup(file); err != nil {
+		return err
+	}
+	if conf.Storage != "files" {
+		return fmt.Errorf("storage %q has no folder layout", conf.Storage)
+	}
+	if depth < 0 {
+		return errors.New("depth must be positive")
+	}
+
+	report, err := migrateLayout(conf.Root, depth, dryRun, w)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Fprintf(w, "%d pastes to move, %d already at depth %d\n", report.Moved, report.InPlace, depth)
+	} else {
+		fmt.Fprintf(w, "%d pastes moved, %d already at depth %d, %d failed\n", report.Moved, report.InPlace, depth, report.Failed)
+		if report.Failed == 0 {
+			fmt.Fprintf(w, "Set depth to %d in %s before restarting the server\n", depth, file)
+		}
+	}
+	return nil
+}
+
+// Move the pastes of a data folder to a new depth.
+func migrateLayout(root string, depth int, dryRun bool, w io.Writer) (MigrateReport, error) {
+	var report MigrateReport
+	target := &fileBackend{root: root, depth: depth}
+
+	// Pastes moved to folders visited later are found again
+	moved := make(map[string]bool)
+	err := walkFolder(root, "", func(id, p string) error {
+		if moved[id] {
+			return nil
+		}
+		if 2*depth >= len(id) {
+			fmt.Fprintf(w, "Paste %s: id too short for depth %d\n", id, depth)
+			report.Failed++
+			return nil
+		}
+
+		dest := target.path(id)
+		if dest == p {
+			report.InPlace++
+			return nil
+		}
+
+		moved[id] = true
+		if dryRun {
+			fmt.Fprintf(w, "Move %s to %s\n", p, dest)
+			report.Moved++
+			return nil
+		}
+
+		if err := movePaste(p, dest); err != nil {
+			fmt.Fprintf(w, "Paste %s: %s\n", id, err)
+			report.Failed++
+			return nil
+		}
+		report.Moved++
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if !dryRun {
+		removeEmptyFolders(root)
+	}
+	return report, nil
+}
+
+// Move a paste file and its related files and folders to a new path.
+// Related files are named after the paste file, followed by a character which
+// cannot appear in ids (eg. the discussion folder, ending with _).
+func movePaste(p, dest string) error {
+	if err := setupFolder(filepath.Dir(dest), 0770); err != nil {
+		return err
+	}
+
+	matches, err := filepath.Glob(p + "*")
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, p)
+		if suffix == "" || regexName.MatchString(suffix[:1]) {
+			// The paste file itself, or another paste
+			continue
+		}
+		if err := moveEntry(match, dest+suffix); err != nil {
+			return err
+		}
+	}
+
+	// Move the paste file last, marking the paste as migrated
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	return os.Rename(p, dest)
+}
+
+// Move a file or a folder.
+// When moving a folder onto an existing one (eg. after an interrupted move),
+// the content of both folders is merged.
+func moveEntry(p, dest string) error {
+	stat, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return os.Rename(p, dest)
+	}
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s already exists", dest)
+	}
+
+	children, err := filepath.Glob(filepath.Join(p, "*"))
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := moveEntry(child, filepath.Join(dest, filepath.Base(child))); err != nil {
+			return err
+		}
+	}
+	return os.Remove(p)
+}
+
+// Remove the empty subfolders of a folder hierarchy.
+// Returns whether folder itself is empty.
+func removeEmptyFolders(folder string) bool {
+	matches, err := filepath.Glob(filepath.Join(folder, "*"))
+	if err != nil {
+		return false
+	}
+	empty := true
+	for _, match := range matches {
+		stat, err := os.Lstat(match)
+		if err == nil && stat.IsDir() && regexName.MatchString(filepath.Base(match)) && removeEmptyFolders(match) {
+			if os.Remove(match) == nil {
+				continue
+			}
+		}
+		empty = false
+	}
+	return empty
+}
@@ -0,0 +1,64 @@
+package bingo
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMigrateLayout(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+
+	s := newFileStore(root, 2)
+	pastes := make([]Paste, 3)
+	for i := range pastes {
+		pastes[i] = newPaste("Awesome paste")
+		pastes[i].Discussion = true
+		if err := s.CreatePaste(&pastes[i]); err != nil {
+			t.Fatal(err)
+		}
+		comment := newComment("Comment", nil)
+		if err := s.AppendComment(&pastes[i], &comment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Dry run leaves the data folder untouched
+	report, err := migrateLayout(root, 3, true, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Moved != 3 {
+		t.Errorf("migrateLayout() dry run moved %d pastes, want 3", report.Moved)
+	}
+	if _, err := s.GetPaste(pastes[0].Id); err != nil {
+		t.Errorf("paste %s was moved by a dry run", pastes[0].Id)
+	}
+
+	// Simulate an interrupted migration
+	if err := movePaste(s.b.(*fileBackend).path(pastes[0].Id), (&fileBackend{root: root, depth: 3}).path(pastes[0].Id)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = migrateLayout(root, 3, false, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Moved != 2 || report.InPlace != 1 || report.Failed != 0 {
+		t.Errorf("migrateLayout() == %+v, want 2 moved and 1 in place", report)
+	}
+
+	moved := newFileStore(root, 3)
+	for _, p := range pastes {
+		if _, err := moved.GetPaste(p.Id); err != nil {
+			t.Errorf("paste %s not found at depth 3: %s", p.Id, err)
+		}
+		if comments, err := moved.ListComments(&p); err != nil || len(comments) != 1 {
+			t.Errorf("paste %s has comments %v, %v at depth 3, want 1 comment", p.Id, comments, err)
+		}
+		if _, err := s.GetPaste(p.Id); err != ErrNotFound {
+			t.Errorf("paste %s still found at depth 2", p.Id)
+		}
+	}
+}
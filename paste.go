@@ -2,16 +2,8 @@ package bingo
 
 import (
 	"crypto/hmac"
-	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
-	"errors"
-	"io/ioutil"
-	"os"
-	"path"
-	"path/filepath"
-	"sort"
 	"time"
 )
 
@@ -20,170 +12,250 @@ A paste.
 
  - Id: paste id
  - Data: paste (encrypted) data
- - Expire: paste expiration date
+ - Expire: paste expiration date, zero if the paste never expires
+ - ExpireAfterView: number of seconds the paste is kept after its first view, 0 for no limit
+ - FirstView: first view date, for pastes expiring after their first view
+ - Trashed: date the paste was moved to the trash, zero unless it was deleted or expired and can still be restored
+ - Hold: legal hold of the paste, if any, never sent to readers
  - Postdate: paste creation date
- - Burn: whether this paste must be deleted once read
+ - Revision: number of the latest revision, 0 until the paste is edited
+ - Updated: latest revision date, if the paste was edited
+ - Burn: whether this paste must be deleted once read, same as MaxViews 1
+ - MaxViews: number of views before the paste is deleted, 0 for no limit
+ - Views: number of views so far, for pastes with a view limit
  - Highlight: whether to enable syntax highlighting
  - Discussion: whether discussions are enabled
  - Comments: paste comments
+ - Attachments: files attached to the paste
 */
 type Paste struct {
-	Id         string    `json:"id"`
-	Data       string    `json:"data"`
-	Expire     time.Time `json:"expire"`
-	Postdate   time.Time `json:"postdate"`
-	Burn       bool      `json:"burn"`
-	Highlight  bool      `json:"highlight"`
-	Discussion bool      `json:"discussion"`
-	Comments   []Comment `json:"comments"`
+	Id              string       `json:"id"`
+	Data            string       `json:"data"`
+	Expire          time.Time    `json:"expire"`
+	ExpireAfterView int          `json:"expireafterview"`
+	FirstView       time.Time    `json:"firstview"`
+	Trashed         time.Time    `json:"trashed"`
+	Hold            *Hold        `json:"hold,omitempty"`
+	Postdate        time.Time    `json:"postdate"`
+	Revision        int          `json:"revision"`
+	Updated         time.Time    `json:"updated"`
+	Burn            bool         `json:"burn"`
+	MaxViews        int          `json:"maxviews"`
+	Views           int          `json:"views"`
+	Highlight       bool         `json:"highlight"`
+	Discussion      bool         `json:"discussion"`
+	Comments        []Comment    `json:"comments"`
+	Attachments     []Attachment `json:"attachments"`
+}
+
+/*
+A legal hold, preserving a paste against expiration and deletion.
+
+ - Date: date the hold was placed
+ - Reason: why the paste is held, eg. a case reference
+*/
+type Hold struct {
+	Date   time.Time `json:"date"`
+	Reason string    `json:"reason"`
 }
 
 // Create a new paste.
-// Setup paste postdate and id.
+// Setup paste postdate and a random id.
 func newPaste(data string) Paste {
 	paste := Paste{
+		Id:       newId(),
 		Data:     data,
 		Postdate: time.Now(),
 	}
-	paste.computeId()
 	return paste
 }
 
-// Compute paste id from data.
-func (paste *Paste) computeId() {
-	hash := sha1.Sum([]byte(paste.Data))
-	paste.Id = hex.EncodeToString(hash[:10])
-}
-
-// Compute a paste delete token.
-func (paste *Paste) hmac(key []byte) string {
-	mac := hmac.New(sha256.New, key)
-	mac.Write([]byte(paste.Data))
-	hash := mac.Sum(nil)
-	return hex.EncodeToString(hash[:10])
+// Save a new paste to the store and add it to the index.
+// Room is made for the paste according to the quota, and a new id is drawn
+// as long as the paste id is already in use.
+func createPaste(paste *Paste) error {
+	for i := 1; ; i++ {
+		err := savePaste(paste)
+		if err != ErrExists || i == idAttempts {
+			return err
+		}
+		Loggers.Warn.Printf("Paste id %s is already in use, draw another one", paste.Id)
+		paste.Id = newId()
+	}
 }
 
-// Validate a paste delete token.
-func (paste *Paste) hmacValidate(token string, key []byte) bool {
-	expected, err := hex.DecodeString(token)
-	if err != nil {
-		Loggers.Error.Panicf("Cannot decode token %s: %s", token, err.Error())
+// Save a new paste and its attachments to the store and add it to the index.
+// Room is made for the paste according to the quota, and ErrExists is
+// returned if the paste id is already in use.
+func savePaste(paste *Paste) error {
+	if hasQuota() {
+		quotaLock.Lock()
+		defer quotaLock.Unlock()
+		if err := makeRoom(paste.size(), 1, ""); err != nil {
+			return err
+		}
 	}
-	mac := hmac.New(sha256.New, key)
-	mac.Write([]byte(paste.Data))
-	computed := mac.Sum(nil)
-	return hmac.Equal(computed[:10], expected)
-}
 
-// Check if a paste has expired.
-func (paste *Paste) hasExpired() bool {
-	return paste.Expire.Before(time.Now())
+	if err := store.CreatePaste(paste); err != nil {
+		return err
+	}
+	if err := saveAttachments(paste); err != nil {
+		if delErr := store.DeletePaste(paste.Id); delErr != nil {
+			Loggers.Error.Printf("Cannot delete paste %s: %s", paste.Id, delErr)
+		}
+		return err
+	}
+	paste.index()
+	return nil
 }
 
-// Compute the storage path of a paste.
-func (paste *Paste) storagePath() string {
-	if 2*conf.Depth >= len(paste.Id) {
-		panic(errors.New("depth too big"))
+// Delete a paste from the store and the index.
+// With a trash, the paste is moved to the trash instead, see trashPaste.
+// Pastes under legal hold are kept, and ErrHeld is returned.
+func deletePaste(id string) error {
+	if hasTrash() {
+		_, err := trashPaste(id)
+		return err
 	}
-	s := conf.Root
-	for i := 0; i < conf.Depth; i++ {
-		s = path.Join(s, paste.Id[2*i:2*(i+1)])
+	err := store.DeletePaste(id)
+	if err != ErrHeld {
+		unindex(id)
 	}
-	s = filepath.Clean(path.Join(s, paste.Id[2*conf.Depth:]))
-	Loggers.Trace.Printf("Computed paste %s storage path: %s", paste.Id, s)
-	return s
+	return err
 }
 
-// Compute the discussion folder path of a paste.
-func (paste *Paste) discussionPath() string {
-	return paste.storagePath() + "_"
+// Whether deleted and expired pastes are moved to the trash.
+func hasTrash() bool {
+	return conf.TrashGrace > 0
 }
 
-// Save a paste to disk.
-func (paste *Paste) save() error {
-	Loggers.Info.Printf("Save paste %s", paste.Id)
-
-	p := paste.storagePath()
-
-	if err := setupFolder(filepath.Dir(p), 0770); err != nil {
-		return err
+// Move a paste to the trash. The cleaner purges it TrashGrace seconds later,
+// unless its owner restores it meanwhile.
+func trashPaste(id string) (Paste, error) {
+	paste, err := store.TrashPaste(id)
+	if err != nil {
+		return paste, err
 	}
+	indexTrash(id, true, paste.cleanDate())
+	return paste, nil
+}
 
-	// Marshal paste
-	s, err := json.Marshal(paste)
+// Move a paste out of the trash, and index it again if it was purged from
+// the index meanwhile.
+func restorePaste(id string) (Paste, error) {
+	paste, err := store.RestorePaste(id)
 	if err != nil {
-		return err
+		return paste, err
+	}
+	if !indexTrash(id, false, retainedUntil(&paste, paste.size())) {
+		paste.index()
 	}
+	return paste, nil
+}
 
-	return ioutil.WriteFile(p, s, 0640)
+// Date the cleaner handles a paste: its expiration date, or the end of its
+// grace period once in the trash.
+func (paste *Paste) cleanDate() time.Time {
+	if !paste.Trashed.IsZero() {
+		return paste.Trashed.Add(time.Duration(conf.TrashGrace) * time.Second)
+	}
+	return paste.expiration()
 }
 
-// Load a paste from disk.
-func loadPaste(id string) (Paste, error) {
-	Loggers.Info.Printf("Load paste %s", id)
+// Number of views of a paste before it is deleted, 0 for no limit.
+// Burn pastes (including pastes stored before view limits) are read once.
+func (paste *Paste) viewLimit() int {
+	if paste.MaxViews > 0 {
+		return paste.MaxViews
+	}
+	if paste.Burn {
+		return 1
+	}
+	return 0
+}
 
-	paste := &Paste{Id: id}
-	p := paste.storagePath()
+// Number of views left for a paste with a view limit.
+func (paste *Paste) remainingViews() int {
+	if n := paste.viewLimit() - paste.Views; n > 0 {
+		return n
+	}
+	return 0
+}
 
-	// Read file
-	data, err := ioutil.ReadFile(p)
+// Load a paste and count a view, see Store.ViewPaste. A paste is deleted
+// from the store and the index on its last view, unless it is under legal
+// hold: concurrent views of a paste never exceed its view limit, others get
+// ErrNotFound.
+func viewPaste(id string) (Paste, error) {
+	paste, err := store.ViewPaste(id)
 	if err != nil {
-		Loggers.Error.Printf("Paste read error %s: %s", id, err)
-		return Paste{}, err
+		return paste, err
 	}
-
-	// Unmarshal data
-	if err := json.Unmarshal(data, &paste); err != nil {
-		Loggers.Error.Printf("Paste unmarshal error %s: %s", id, err)
-		return Paste{}, err
+	if paste.viewLimit() > 0 && paste.remainingViews() == 0 && paste.Hold == nil {
+		unindex(id)
+	} else if paste.ExpireAfterView > 0 {
+		// The first view may bring the expiration date forward
+		indexExpire(id, retainedUntil(&paste, paste.size()))
 	}
-
-	return *paste, nil
+	return paste, nil
 }
 
-// Delete a paste from disk.
-func (paste *Paste) del() error {
-	Loggers.Info.Printf("Delete paste %s", paste.Id)
-
-	p := paste.storagePath()
-
-	if err := os.Remove(p); err != nil {
-		return err
+// Approximate storage size of a paste, its comments and its attachments.
+func (paste *Paste) size() int64 {
+	size := int64(len(paste.Data))
+	for i := range paste.Comments {
+		size += paste.Comments[i].size()
 	}
-
-	// Delete paste discussion if any
-	if paste.Discussion {
-		d := paste.discussionPath()
-		if err := os.RemoveAll(d); err != nil {
-			return err
-		}
+	for i := range paste.Attachments {
+		size += paste.Attachments[i].Size
 	}
-
-	return nil
+	return size
 }
 
-// Load a paste comments.
-func (paste *Paste) loadComments() error {
-	Loggers.Info.Printf("Load comments of paste %s", paste.Id)
+// Compute a paste delete token.
+func (paste *Paste) hmac(key []byte) string {
+	return hex.EncodeToString(paste.mac(key))
+}
 
-	p := paste.discussionPath()
+// Compute the MAC of a paste id and data, so that pastes holding the same
+// data get different tokens.
+func (paste *Paste) mac(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(paste.Id))
+	// Ids never hold a zero byte
+	mac.Write([]byte{0})
+	mac.Write([]byte(paste.Data))
+	return mac.Sum(nil)[:10]
+}
 
-	matches, err := filepath.Glob(filepath.Join(p, "*"))
+// Validate a paste delete token.
+func (paste *Paste) hmacValidate(token string, key []byte) bool {
+	expected, err := hex.DecodeString(token)
 	if err != nil {
-		return err
+		Loggers.Warn.Printf("Cannot decode token %s: %s", token, err)
+		return false
 	}
+	return hmac.Equal(paste.mac(key), expected)
+}
 
-	paste.Comments = make([]Comment, len(matches))
-
-	for i, s := range matches {
-		c, err := loadComment(filepath.Base(s), paste)
-		if err != nil {
-			return err
+// Expiration date of a paste: its expiration date, or the end of the delay
+// following its first view if earlier. Zero if the paste never expires.
+func (paste *Paste) expiration() time.Time {
+	if paste.ExpireAfterView > 0 && !paste.FirstView.IsZero() {
+		if end := paste.FirstView.Add(time.Duration(paste.ExpireAfterView) * time.Second); expiresBefore(end, paste.Expire) {
+			return end
 		}
-		paste.Comments[i] = c
 	}
+	return paste.Expire
+}
 
-	sort.Sort(CommentsByDate(paste.Comments))
+// Whether a paste view must be counted by the store: pastes with a view
+// limit, and pastes expiring after a first view which did not happen yet.
+func (paste *Paste) countsViews() bool {
+	return paste.viewLimit() > 0 || (paste.ExpireAfterView > 0 && paste.FirstView.IsZero())
+}
 
-	return nil
+// Check if a paste has expired.
+func (paste *Paste) hasExpired() bool {
+	return expiresBefore(paste.expiration(), time.Now())
 }
@@ -1,28 +1,56 @@
 package bingo
 
 import (
+	"regexp"
 	"testing"
+	"time"
 )
 
 func init() {
 	// Disable logging
 	setVerbosity(0)
+
+	// Delete tokens are computed with the server key
+	tokenKey = []byte("test token key")
 }
 
-func TestComputeId(t *testing.T) {
+func TestNewId(t *testing.T) {
 
-	pastes := []struct {
-		data, id string
+	formats := []struct {
+		alphabet string
+		length   int
+		pattern  string
 	}{
-		{"Awesome paste", "d9441ab2ce8126457ecd"},
-		{"1337", "77ba9cd915c8e359d973"},
-		{"", "da39a3ee5e6b4b0d3255"},
+		{"hex", 20, "^[0-9a-f]{20}$"},
+		{"base62", 8, "^[0-9A-Za-z]{8}$"},
+		{"xyz", 12, "^[xyz]{12}$"},
 	}
 
-	for _, p := range pastes {
-		paste := newPaste(p.data)
-		if paste.Id != p.id {
-			t.Errorf("newPaste(%q).Id == %q, want %q", p.data, paste.Id, p.id)
+	defer func(alphabet string, length int) {
+		conf.IdAlphabet, conf.IdLength = alphabet, length
+	}(conf.IdAlphabet, conf.IdLength)
+
+	for _, f := range formats {
+		conf.IdAlphabet, conf.IdLength = f.alphabet, f.length
+		ids := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			id := newPaste("Awesome paste").Id
+			if !regexp.MustCompile(f.pattern).MatchString(id) {
+				t.Errorf("newPaste().Id == %q, want match for %s", id, f.pattern)
+			}
+			ids[id] = true
+		}
+		if len(ids) < 95 {
+			t.Errorf("100 newPaste() with alphabet %q gave %d distinct ids", f.alphabet, len(ids))
+		}
+		if !regexp.MustCompile("^" + idPattern() + "$").MatchString("d9441ab2ce8126457ecd") {
+			t.Errorf("idPattern() == %q does not match legacy ids", idPattern())
+		}
+	}
+
+	for _, alphabet := range []string{"a", "aab", "a-b", ""} {
+		if _, err := resolveIdAlphabet(alphabet); err == nil {
+			t.Errorf("resolveIdAlphabet(%q) succeeded, want error", alphabet)
 		}
 	}
 
@@ -30,50 +58,48 @@ func TestComputeId(t *testing.T) {
 
 func TestPath(t *testing.T) {
 
-	// Setup conf
-	conf.Root = "/path/to/dir/"
 	// With default depth (2)
+	root := "/path/to/dir/"
+	b := &fileBackend{root: root, depth: 2}
 
 	pastes := []struct {
-		data, id, path string
+		id, path string
 	}{
-		{"Awesome paste", "d9441ab2ce8126457ecd", conf.Root + "d9/44/1ab2ce8126457ecd"},
-		{"1337", "77ba9cd915c8e359d973", conf.Root + "77/ba/9cd915c8e359d973"},
-		{"", "da39a3ee5e6b4b0d3255", conf.Root + "da/39/a3ee5e6b4b0d3255"},
+		{"d9441ab2ce8126457ecd", root + "d9/44/1ab2ce8126457ecd"},
+		{"77ba9cd915c8e359d973", root + "77/ba/9cd915c8e359d973"},
+		{"da39a3ee5e6b4b0d3255", root + "da/39/a3ee5e6b4b0d3255"},
 	}
 
 	for _, p := range pastes {
-		paste := newPaste(p.data)
-		path := paste.storagePath()
-		dpath := paste.discussionPath()
+		path := b.path(p.id)
+		dpath := b.path(discussionKey(p.id))
 		if path != p.path {
-			t.Errorf("newPaste(%q).storagePath() == %q, want %q", p.data, path, p.path)
+			t.Errorf("path(%q) == %q, want %q", p.id, path, p.path)
 		}
 		if dpath != p.path+"_" {
-			t.Errorf("newPaste(%q).discussionPath() == %q, want %q", p.data, path, p.path+"_")
+			t.Errorf("path(%q) == %q, want %q", discussionKey(p.id), dpath, p.path+"_")
 		}
 	}
 
 	// With custom depth
-	conf.Depth = 5
+	b.depth = 5
 
 	pastes = []struct {
-		data, id, path string
+		id, path string
 	}{
-		{"Awesome paste", "d9441ab2ce8126457ecd", conf.Root + "d9/44/1a/b2/ce/8126457ecd"},
-		{"1337", "77ba9cd915c8e359d973", conf.Root + "77/ba/9c/d9/15/c8e359d973"},
-		{"", "da39a3ee5e6b4b0d3255", conf.Root + "da/39/a3/ee/5e/6b4b0d3255"},
+		{"d9441ab2ce8126457ecd", root + "d9/44/1a/b2/ce/8126457ecd"},
+		{"77ba9cd915c8e359d973", root + "77/ba/9c/d9/15/c8e359d973"},
+		{"da39a3ee5e6b4b0d3255", root + "da/39/a3/ee/5e/6b4b0d3255"},
 	}
 
 	for _, p := range pastes {
-		paste := newPaste(p.data)
-		path := paste.storagePath()
-		dpath := paste.discussionPath()
+		path := b.path(p.id)
+		dpath := b.path(discussionKey(p.id))
 		if path != p.path {
-			t.Errorf("newPaste(%q).storagePath() == %q, want %q", p.data, path, p.path)
+			t.Errorf("path(%q) == %q, want %q", p.id, path, p.path)
 		}
 		if dpath != p.path+"_" {
-			t.Errorf("newPaste(%q).discussionPath() == %q, want %q", p.data, path, p.path+"_")
+			t.Errorf("path(%q) == %q, want %q", discussionKey(p.id), dpath, p.path+"_")
 		}
 	}
 
@@ -84,27 +110,52 @@ func TestDeleteToken(t *testing.T) {
 	pastes := []struct {
 		data, token string
 	}{
-		{"Awesome paste", "035fd1a9ccb554b8cb8f"},
-		{"1337", "236f915ae883155a5766"},
-		{"", "537c24565a8207e2b7d9"},
+		{"Awesome paste", "bddf461acea2b9e66268"},
+		{"1337", "82da95c6643b5458c8d1"},
+		{"", "fbaa6a929ddb5bbccd13"},
 	}
 
 	// Server secret key
 	key := []byte("hakuna matata")
 
 	for _, p := range pastes {
-		paste := newPaste(p.data)
+		paste := Paste{Id: "0123456789abcdef0123", Data: p.data}
 		hmac := paste.hmac(key)
 		if hmac != p.token {
-			t.Errorf("newPaste(%q).hmac(<key>) == %q, want %q", p.data, hmac, p.token)
+			t.Errorf("Paste{%q}.hmac(<key>) == %q, want %q", p.data, hmac, p.token)
 		}
-	}
-
-	for _, p := range pastes {
-		paste := newPaste(p.data)
 		if !paste.hmacValidate(p.token, key) {
-			t.Errorf("newPaste(%q).hmacValidate(%q, <key>) is false, want true", p.data, p.token)
+			t.Errorf("Paste{%q}.hmacValidate(%q, <key>) is false, want true", p.data, p.token)
 		}
 	}
 
+	// Pastes holding the same data get different tokens
+	first, second := newPaste("Awesome paste"), newPaste("Awesome paste")
+	if first.hmac(key) == second.hmac(key) {
+		t.Errorf("pastes %s and %s share delete token %s", first.Id, second.Id, first.hmac(key))
+	}
+	if second.hmacValidate(first.hmac(key), key) {
+		t.Errorf("paste %s accepts the delete token of paste %s", second.Id, first.Id)
+	}
+
+}
+
+func TestPasteExpiration(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		expireAfterView int
+		firstView       time.Time
+		want            time.Time
+	}{
+		{0, now, now.Add(time.Hour)},
+		{60, time.Time{}, now.Add(time.Hour)},
+		{60, now, now.Add(time.Minute)},
+		{7200, now, now.Add(time.Hour)},
+	}
+	for _, test := range tests {
+		paste := Paste{Expire: now.Add(time.Hour), ExpireAfterView: test.expireAfterView, FirstView: test.firstView}
+		if got := paste.expiration(); !got.Equal(test.want) {
+			t.Errorf("expiration() after %d seconds from %s == %s, want %s", test.expireAfterView, test.firstView, got, test.want)
+		}
+	}
 }
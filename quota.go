@@ -0,0 +1,107 @@
+package bingo
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrQuota is returned when there is no room left for new data.
+var ErrQuota = errors.New("storage quota exceeded")
+
+// Serializes quota checks and the writes they allow.
+var quotaLock sync.Mutex
+
+// Check whether the quota is enabled.
+func hasQuota() bool {
+	return conf.QuotaBytes > 0 || conf.QuotaPastes > 0
+}
+
+// Check whether adding size bytes and count pastes to the index exceeds the quota.
+func overQuota(size int64, count int) bool {
+	index.RLock()
+	defer index.RUnlock()
+	if conf.QuotaBytes > 0 && index.size+size > conf.QuotaBytes {
+		return true
+	}
+	if conf.QuotaPastes > 0 && len(index.h)+count > conf.QuotaPastes {
+		return true
+	}
+	return false
+}
+
+// Make room for size bytes and count new pastes.
+// According to the quota policy, either fail with ErrQuota or evict the
+// pastes closest to their expiration date until the new data fits.
+// The paste whose id is keep is never evicted.
+// Caller must hold quotaLock.
+func makeRoom(size int64, count int, keep string) error {
+	if !overQuota(size, count) {
+		return nil
+	}
+
+	if conf.QuotaPolicy != "evict" {
+		Loggers.Warn.Printf("Quota exceeded, reject %d bytes", size)
+		return ErrQuota
+	}
+
+	if conf.QuotaBytes > 0 && size > conf.QuotaBytes {
+		// Would not fit even in an empty store
+		return ErrQuota
+	}
+
+	index.RLock()
+	needBytes := index.size + size - conf.QuotaBytes
+	needPastes := len(index.h) + count - conf.QuotaPastes
+	index.RUnlock()
+
+	// Evict pastes one at a time, counting only those actually deleted
+	var freedBytes int64
+	var freedPastes int
+	var kept []indexEntry
+	for (conf.QuotaBytes > 0 && freedBytes < needBytes) ||
+		(conf.QuotaPastes > 0 && freedPastes < needPastes) {
+		taken := false
+		next := unindexFirst(func(e indexEntry) bool {
+			if taken {
+				return true
+			}
+			taken = true
+			return false
+		})
+		if len(next) == 0 {
+			// No candidate left
+			break
+		}
+		e := next[0]
+		if e.id == keep {
+			kept = append(kept, e)
+			continue
+		}
+		Loggers.Info.Printf("Quota exceeded, evict paste %s expiring on %s", e.id, e.expire)
+		err := store.DeletePaste(e.id)
+		if err == ErrHeld {
+			// Pastes under legal hold are never evicted, try the next one
+			kept = append(kept, e)
+			continue
+		}
+		if err != nil && err != ErrNotFound {
+			Loggers.Error.Printf("Cannot evict paste %s: %s", e.id, err)
+			kept = append(kept, e)
+			continue
+		}
+		freedBytes += e.size
+		freedPastes++
+	}
+
+	// Put back the pastes which were not evicted
+	index.Lock()
+	for _, e := range kept {
+		addIndexEntry(e)
+	}
+	index.Unlock()
+
+	if overQuota(size, count) {
+		return ErrQuota
+	}
+	return nil
+}
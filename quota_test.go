@@ -0,0 +1,115 @@
+package bingo
+
+import (
+	"testing"
+	"time"
+)
+
+// Setup an empty memory store and index for tests relying on the global store.
+func setupTestStore() {
+	store = newMemoryStore()
+	index.Lock()
+	resetIndex(nil)
+	index.Unlock()
+}
+
+func TestQuota(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+
+	conf.QuotaPastes = 2
+	conf.QuotaPolicy = "reject"
+
+	now := time.Now()
+	pastes := make([]Paste, 3)
+	for i := range pastes {
+		pastes[i] = newPaste("Awesome paste")
+		// Last paste expires first
+		pastes[i].Expire = now.Add(time.Duration(len(pastes)-i) * time.Hour)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := createPaste(&pastes[i]); err != nil {
+			t.Fatalf("createPaste() error: %s", err)
+		}
+	}
+	if err := createPaste(&pastes[2]); err != ErrQuota {
+		t.Errorf("createPaste() over quota error == %v, want %v", err, ErrQuota)
+	}
+
+	// Evict the paste closest to its expiration date
+	conf.QuotaPolicy = "evict"
+	if err := createPaste(&pastes[2]); err != nil {
+		t.Fatalf("createPaste() with eviction error: %s", err)
+	}
+	if _, err := store.GetPaste(pastes[1].Id); err != ErrNotFound {
+		t.Errorf("paste %s expiring first was not evicted", pastes[1].Id)
+	}
+	for _, i := range []int{0, 2} {
+		if _, err := store.GetPaste(pastes[i].Id); err != nil {
+			t.Errorf("paste %s was evicted", pastes[i].Id)
+		}
+	}
+
+	// Byte quota
+	conf.QuotaPastes = 0
+	conf.QuotaBytes = index.size + 5
+	comment := newComment("Too long comment", nil)
+	conf.QuotaPolicy = "reject"
+	if err := createComment(&pastes[0], &comment); err != ErrQuota {
+		t.Errorf("createComment() over quota error == %v, want %v", err, ErrQuota)
+	}
+	comment = newComment("Ok", nil)
+	if err := createComment(&pastes[0], &comment); err != nil {
+		t.Errorf("createComment() within quota error: %s", err)
+	}
+}
+
+func TestQuotaEvictHeld(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+
+	conf.QuotaPastes = 2
+	conf.QuotaPolicy = "evict"
+
+	now := time.Now()
+	pastes := make([]Paste, 3)
+	for i := range pastes {
+		pastes[i] = newPaste("Awesome paste")
+		pastes[i].Expire = now.Add(time.Duration(i+1) * time.Hour)
+	}
+	for i := 0; i < 2; i++ {
+		if err := createPaste(&pastes[i]); err != nil {
+			t.Fatalf("createPaste() error: %s", err)
+		}
+	}
+	if err := placeHold(pastes[0].Id, "Case 42"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The held paste expires first, the next one is evicted instead
+	if err := createPaste(&pastes[2]); err != nil {
+		t.Fatalf("createPaste() with a held paste error: %s", err)
+	}
+	if _, err := store.GetPaste(pastes[0].Id); err != nil {
+		t.Errorf("held paste %s was evicted", pastes[0].Id)
+	}
+	if _, err := store.GetPaste(pastes[1].Id); err != ErrNotFound {
+		t.Errorf("paste %s was not evicted", pastes[1].Id)
+	}
+	if overQuota(0, 0) {
+		t.Errorf("quota exceeded after eviction")
+	}
+
+	// Only held pastes are left to evict
+	if err := placeHold(pastes[2].Id, "Case 42"); err != nil {
+		t.Fatal(err)
+	}
+	extra := newPaste("Awesome paste")
+	if err := createPaste(&extra); err != ErrQuota {
+		t.Errorf("createPaste() with only held pastes error == %v, want %v", err, ErrQuota)
+	}
+	if len(index.h) != 2 {
+		t.Errorf("index has %d entries, want 2", len(index.h))
+	}
+}
@@ -32,6 +32,11 @@ function displayDiscussion(show) {
 	display('#discussion', show);
 }
 
+// Display or hide the reveal of a paste with a view limit
+function displayReveal(show) {
+	display('#reveal', show);
+}
+
 // Display raw paste data
 function raw() {
 	var data = $('#meta-plain').val();
@@ -97,6 +102,44 @@ function getHash() {
 	}
 }
 
+// Get the message to display for a failed request
+function errorMessage(jqXHR, textStatus) {
+	if (textStatus === "error") {
+		// The server replied with an HTTP error code
+		if (jqXHR.responseJSON && jqXHR.responseJSON.error) {
+			return jqXHR.responseJSON.error;
+		}
+		if (jqXHR.status === 413) {
+			return "Your paste is too large.";
+		}
+	}
+	// An error occurred
+	return "Oops, an error occurred.";
+}
+
+// Read the files to attach to a paste as data URLs
+// callback is called with the list of files once they are all read
+function readAttachments(callback) {
+	var files = $('#form input[name=attachments]').prop('files') || [];
+	var attachments = [];
+	var pending = files.length;
+	if (pending === 0) {
+		callback(attachments);
+		return;
+	}
+	$.each(files, function(i, file) {
+		var reader = new FileReader();
+		reader.onload = function() {
+			attachments[i] = {name: file.name, data: reader.result};
+			pending--;
+			if (pending === 0) {
+				callback(attachments);
+			}
+		};
+		reader.readAsDataURL(file);
+	});
+}
+
 // Send a new paste
 function send() {
 	// Get plaintext
@@ -104,7 +147,14 @@ function send() {
 	if (plaintext.length === 0) {
 		return;
 	}
-	
+
+	readAttachments(function(files) {
+		sendPaste(plaintext, files);
+	});
+}
+
+// Send a new paste with its attachments
+function sendPaste(plaintext, files) {
 	// Generate random key
 	var randomkey = sjcl.codec.base64.fromBits(sjcl.random.randomWords(8, 0), 0);
 	
@@ -112,9 +162,17 @@ function send() {
 	var data = {
 		data: encrypt(randomkey, plaintext),
 		expire: parseInt($('#form select[name=expire]').val()),
+		expireafterview: parseInt($('#form select[name=expireafterview]').val()),
 		burn: $('#form input[name=burn]').prop('checked'),
+		maxviews: parseInt($('#form input[name=maxviews]').val()) || 0,
 		discussion: $('#form input[name=discussion]').prop('checked'),
-		highlight: $('#form input[name=highlight]').prop('checked')
+		highlight: $('#form input[name=highlight]').prop('checked'),
+		attachments: files.map(function(file) {
+			return {
+				name: encrypt(randomkey, file.name),
+				data: encrypt(randomkey, file.data)
+			};
+		})
 	};
 
 	// Send paste
@@ -126,13 +184,7 @@ function send() {
 		accept: "application/json",
 		error: function(jqXHR, textStatus, errorThrown) {
 			console.log(jqXHR);
-			if (textStatus === "error") {
-				// The server replied with an HTTP error code
-				displayDanger(jqXHR.responseJSON.error || "Oops, an error occurred.");
-			} else {
-				// An error occurred
-				displayDanger("Oops, an error occurred.");
-			}
+			displayDanger(errorMessage(jqXHR, textStatus));
 		},
 		success: function(response, textStatus, jqXHR) {
 			// Build paste & delete URLs
@@ -149,6 +201,7 @@ function send() {
 				burn: data.burn,
 				discussion: data.discussion,
 				highlight: data.highlight,
+				attachments: data.attachments,
 			};
 			
 			// Display paste
@@ -200,13 +253,7 @@ function comment(parentid) {
 		accept: "application/json",
 		error: function(jqXHR, textStatus, errorThrown) {
 			console.log(jqXHR);
-			if (textStatus === "error") {
-				// The server replied with an HTTP error code
-				displayDanger(jqXHR.responseJSON.error || "Oops, an error occurred.");
-			} else {
-				// An error occurred
-				displayDanger("Oops, an error occurred.");
-			}
+			displayDanger(errorMessage(jqXHR, textStatus));
 		},
 		success: function(response) {
 			// Hide reply form
@@ -237,6 +284,84 @@ function formatDate(date) {
 	return d + " " + t; 
 }
 
+// Load the metadata of a paste with a view limit before revealing it
+function loadMeta(id) {
+	$.ajax({
+		url: baseURL() + "meta/" + id,
+		method: "GET",
+		accept: "application/json",
+		error: function(jqXHR, textStatus, errorThrown) {
+			displayReveal(false);
+			displayDanger(errorMessage(jqXHR, textStatus));
+		},
+		success: function(meta) {
+			$('#reveal-postdate').html(formatDate(new Date(meta.postdate)));
+			$('#reveal-expire').html(formatExpire(meta.expire));
+			$('#reveal-remaining').text(viewsText(meta.remaining));
+		},
+	});
+}
+
+// Text of a number of views
+function viewsText(views) {
+	return (views === 1) ? 'once' : views + ' times';
+}
+
+// Reveal a paste with a view limit: the server sends it and counts a view,
+// the paste is deleted on its last view
+function reveal() {
+	var id = $('#meta #meta-reveal').val();
+	$.ajax({
+		url: baseURL() + "reveal/" + id,
+		method: "POST",
+		accept: "application/json",
+		error: function(jqXHR, textStatus, errorThrown) {
+			displayReveal(false);
+			displayDanger(errorMessage(jqXHR, textStatus));
+		},
+		success: function(response) {
+			paste = response;
+			paste.plaintext = decrypt(getHash(), paste.data);
+
+			var remaining = (paste.maxviews || 1) - paste.views;
+			if (remaining > 0) {
+				displayWarning('This paste can be displayed ' + viewsText(remaining) + ' more before it is destroyed.');
+			} else {
+				displayWarning('This paste was destroyed once read. Do not close this window, paste data cannot be displayed again.');
+			}
+			fillPaste(paste);
+			displayReveal(false);
+			displayPaste(true);
+		},
+	});
+}
+
+// Restore a deleted paste from the trash, using its delete token
+function undelete() {
+	var path = $('#meta #meta-undelete').val();
+	$.ajax({
+		url: baseURL() + path,
+		method: "POST",
+		accept: "application/json",
+		error: function(jqXHR, textStatus, errorThrown) {
+			displayDanger(errorMessage(jqXHR, textStatus));
+		},
+		success: function(response) {
+			$('#undelete').closest('.alert').remove();
+			displaySuccess('Paste restored, it is available again at its url.');
+		},
+	});
+}
+
+// Format an expiration date, pastes which never expire having a zero date
+function formatExpire(expire) {
+	var date = new Date(expire);
+	if (date.getUTCFullYear() <= 1) {
+		return 'never';
+	}
+	return formatDate(date);
+}
+
 // Fill paste data
 function fillPaste(paste) {
 	// Fill paste data
@@ -254,7 +379,7 @@ function fillPaste(paste) {
 	
 	// Fill paste expiration date
 	if (paste.expire) {
-		$('#paste-expire').html(formatDate(new Date(paste.expire)));
+		$('#paste-expire').html(formatExpire(paste.expire));
 	} else {
 		$('#paste-expire').hide();
 	}
@@ -272,6 +397,12 @@ function fillPaste(paste) {
 	// Configure comment button
 	$('#paste-comment').click(function() { displayCommentForm($('#paste-comment'), ''); });
 	
+	// Fill paste attachments
+	$('#attachments').empty();
+	if (paste.attachments) {
+		paste.attachments.map(appendAttachment);
+	}
+	
 	// Fill paste comments
 	if (paste.comments) {
 		paste.comments.map(appendComment);
@@ -280,6 +411,48 @@ function fillPaste(paste) {
 	displayDiscussion(paste.discussion);
 }
 
+function appendAttachment(attachment) {
+	var name = decrypt(getHash(), attachment.name);
+	
+	// Retrieve & clone attachment template
+	var div = $('#template-attachment').children().first().clone();
+	div.find('.attachment-name').text(name).click(function() {
+		downloadAttachment(attachment, name);
+		return false;
+	});
+	div.find('.attachment-size').text('(' + Math.ceil((attachment.size || attachment.data.length) / 1024) + ' KiB encrypted)');
+	
+	$('#attachments').append(div);
+}
+
+// Decrypt an attachment and save it
+// Attachment data is fetched from the server unless it came with the paste (burn pastes)
+function downloadAttachment(attachment, name) {
+	var save = function(data) {
+		var link = document.createElement('a');
+		link.href = decrypt(getHash(), data);
+		link.download = name;
+		document.body.appendChild(link);
+		link.click();
+		document.body.removeChild(link);
+	};
+	if (attachment.data) {
+		save(attachment.data);
+		return;
+	}
+	$.ajax({
+		url: baseURL() + "attachment/" + paste.id + "/" + attachment.id,
+		method: "GET",
+		accept: "application/json",
+		error: function(jqXHR, textStatus, errorThrown) {
+			displayDanger(errorMessage(jqXHR, textStatus));
+		},
+		success: function(response) {
+			save(response.data);
+		},
+	});
+}
+
 function appendComment(comment) {
 	// Decipher comment data
 	var plain = decrypt(getHash(), comment.data);
@@ -388,8 +561,23 @@ $(function() {
 	// Assume there is no pase and fisplay form
 	displayPaste(false);
 	displayDiscussion(false);
+	displayReveal(false);
 	displayForm(true);
 
+	// Display burn paste reveal if any
+	var revealId = $('#meta #meta-reveal').val();
+	if (revealId.length > 0) {
+		loadMeta(revealId);
+		displayReveal(true);
+		displayForm(false);
+	}
+
+	// Offer to restore a deleted paste
+	$('#undelete').click(function(e) {
+		e.preventDefault();
+		undelete();
+	});
+
 	// Display paste if any
 	var pasteJSON = $('#meta #meta-paste').val();
 	if (pasteJSON.length > 0) {
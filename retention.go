@@ -0,0 +1,154 @@
+package bingo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+A retention rule, capping the lifetime of the pastes it matches.
+A rule matches the pastes meeting all its criteria, a rule without criteria
+matches every paste.
+
+ - Name: rule name, shown in reports
+ - Burn: only match pastes with a view limit
+ - Discussion: only match pastes with discussions enabled
+ - MinSize: only match pastes of at least that many bytes (data, comments, revisions and attachments), 0 for any size
+ - MaxLifetime: maximum lifetime of matched pastes, in seconds
+*/
+type RetentionRule struct {
+	Name        string `json:"name"`
+	Burn        bool   `json:"burn"`
+	Discussion  bool   `json:"discussion"`
+	MinSize     int64  `json:"minSize"`
+	MaxLifetime int    `json:"maxLifetime"`
+}
+
+/*
+Retention policy report, see ReportRetention.
+
+ - Pastes: number of checked pastes
+ - Expired: number of pastes the policy deletes at once
+ - Shortened: number of pastes the policy deletes before their expiration date
+ - Held: number of pastes the policy would delete, kept as they are under legal hold
+*/
+type RetentionReport struct {
+	Pastes    int
+	Expired   int
+	Shortened int
+	Held      int
+}
+
+// Whether a rule matches a paste of size bytes.
+func (rule *RetentionRule) matches(paste *Paste, size int64) bool {
+	if rule.Burn && paste.viewLimit() == 0 {
+		return false
+	}
+	if rule.Discussion && !paste.Discussion {
+		return false
+	}
+	return size >= rule.MinSize
+}
+
+// Rule of the retention policy giving a paste of size bytes the shortest
+// lifetime, nil if no rule matches the paste.
+func retentionRule(paste *Paste, size int64) *RetentionRule {
+	var shortest *RetentionRule
+	for i := range conf.Retention {
+		rule := &conf.Retention[i]
+		if rule.matches(paste, size) && (shortest == nil || rule.MaxLifetime < shortest.MaxLifetime) {
+			shortest = rule
+		}
+	}
+	return shortest
+}
+
+// Expiration date of a paste of size bytes according to the retention policy:
+// its expiration date, brought forward by the rules it matches.
+func retainedUntil(paste *Paste, size int64) time.Time {
+	expire := paste.expiration()
+	if rule := retentionRule(paste, size); rule != nil {
+		if end := paste.Postdate.Add(time.Duration(rule.MaxLifetime) * time.Second); expiresBefore(end, expire) {
+			return end
+		}
+	}
+	return expire
+}
+
+// Checksum of the retention policy, empty without rules.
+// Index snapshots taken under another policy are not loaded, so that the
+// policy is applied to stored pastes when it changes.
+func retentionChecksum() string {
+	if len(conf.Retention) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(conf.Retention)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ReportRetention reports the pastes the retention policy of the
+// configuration deletes before their expiration date, without deleting them.
+// Run it with a new configuration before restarting the server with it: the
+// clean daemon applies the new policy on startup.
+func ReportRetention(file string, w io.Writer) (RetentionReport, error) {
+	if err := openConfStore(file); err != nil {
+		return RetentionReport{}, err
+	}
+
+	report, err := reportRetention(w)
+	if err != nil {
+		return report, err
+	}
+	fmt.Fprintf(w, "%d pastes checked, %d deleted at once, %d deleted before their expiration date, %d kept under legal hold\n", report.Pastes, report.Expired, report.Shortened, report.Held)
+	return report, nil
+}
+
+// Report the pastes the retention policy deletes before their expiration date.
+func reportRetention(w io.Writer) (RetentionReport, error) {
+	var report RetentionReport
+	now := time.Now()
+	err := store.WalkMeta(func(paste *Paste, dataSize int64) error {
+		if !paste.Trashed.IsZero() {
+			// Purged at the end of its grace period
+			return nil
+		}
+		report.Pastes++
+
+		size := indexedSize(paste, dataSize)
+		expire := paste.expiration()
+		retained := retainedUntil(paste, size)
+		if !expiresBefore(retained, expire) {
+			return nil
+		}
+		rule := retentionRule(paste, size)
+		switch {
+		case paste.Hold != nil:
+			report.Held++
+			fmt.Fprintf(w, "%s: kept under legal hold (rule %q)\n", paste.Id, rule.Name)
+		case expiresBefore(retained, now):
+			report.Expired++
+			fmt.Fprintf(w, "%s: deleted at once (rule %q)\n", paste.Id, rule.Name)
+		default:
+			report.Shortened++
+			fmt.Fprintf(w, "%s: deleted on %s instead of %s (rule %q)\n", paste.Id, retained.Format(time.RFC3339), formatExpiration(expire), rule.Name)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// Format an expiration date, "never" for pastes which never expire.
+func formatExpiration(expire time.Time) string {
+	if expire.IsZero() {
+		return "never"
+	}
+	return expire.Format(time.RFC3339)
+}
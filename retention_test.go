@@ -0,0 +1,132 @@
+package bingo
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPost(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	initPatterns()
+
+	conf.Retention = []RetentionRule{
+		{Name: "burn", Burn: true, MaxLifetime: 86400},
+		{Name: "discussion", Discussion: true, MaxLifetime: 2592000},
+		{Name: "large", MinSize: 1000, MaxLifetime: 3600},
+	}
+	requests := []struct {
+		body     string
+		lifetime time.Duration
+	}{
+		{`{"data":"Paste","expire":604800,"burn":true}`, 24 * time.Hour},
+		{`{"data":"Paste","expire":31536000,"discussion":true}`, 30 * 24 * time.Hour},
+		{`{"data":"Paste","expire":300,"discussion":true}`, 5 * time.Minute},
+		{`{"data":"` + strings.Repeat("a", 1000) + `","expire":604800,"discussion":true}`, time.Hour},
+		{`{"data":"Paste","expire":604800}`, 7 * 24 * time.Hour},
+	}
+	for i, req := range requests {
+		antiflood.m = make(map[string]time.Time)
+		var created Postresponse
+		if err := json.Unmarshal(post(req.body).Body.Bytes(), &created); err != nil {
+			t.Fatal(err)
+		}
+		if lifetime := created.Expire.Sub(created.Postdate); lifetime != req.lifetime {
+			t.Errorf("paste #%d lifetime == %s, want %s", i, lifetime, req.lifetime)
+		}
+		if paste, err := store.GetPaste(created.Id); err != nil || !paste.Expire.Equal(created.Expire) {
+			t.Errorf("paste #%d expires on %s, %v, want %s", i, paste.Expire, err, created.Expire)
+		}
+	}
+
+	// Pastes growing past the minimum size of a rule expire earlier
+	antiflood.m = make(map[string]time.Time)
+	var created Postresponse
+	if err := json.Unmarshal(post(`{"data":"Paste","expire":604800}`).Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	paste, err := store.GetPaste(created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := revisePaste(&paste, strings.Repeat("a", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if e := index.ids[created.Id]; !e.expire.Equal(created.Postdate.Add(time.Hour)) {
+		t.Errorf("index expiration after growth == %s, want %s", e.expire, created.Postdate.Add(time.Hour))
+	}
+}
+
+func TestRetentionChange(t *testing.T) {
+	defer func(c Conf, s Store) { conf, store = c, s }(conf, store)
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+
+	conf.Root, conf.Storage, conf.Depth = root, "files", 2
+	store = newFileStore(root, 2)
+	index.Lock()
+	resetIndex(nil)
+	index.Unlock()
+
+	// Pastes stored under another policy
+	pastes := make([]Paste, 3)
+	for i := range pastes {
+		pastes[i] = newPaste("Awesome paste")
+		pastes[i].Postdate = time.Now().Add(-2 * time.Hour)
+		pastes[i].Expire = time.Now().Add(time.Hour)
+	}
+	pastes[0].Burn = true
+	pastes[1].Discussion = true
+	for i := range pastes {
+		if err := createPaste(&pastes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeSnapshot(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new policy deletes the burn paste at once, and the discussion earlier
+	conf.Retention = []RetentionRule{
+		{Name: "burn", Burn: true, MaxLifetime: 3600},
+		{Name: "discussion", Discussion: true, MaxLifetime: 9000},
+	}
+	var out bytes.Buffer
+	report, err := reportRetention(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (RetentionReport{Pastes: 3, Expired: 1, Shortened: 1}); report != want {
+		t.Errorf("reportRetention() == %+v, want %+v", report, want)
+	}
+	if !strings.Contains(out.String(), pastes[0].Id+`: deleted at once (rule "burn")`) {
+		t.Errorf("reportRetention() output == %q, want paste %s deleted at once", out.String(), pastes[0].Id)
+	}
+	for i := range pastes {
+		if _, err := store.GetPaste(pastes[i].Id); err != nil {
+			t.Errorf("GetPaste(%q) after report error: %s", pastes[i].Id, err)
+		}
+	}
+
+	// Snapshots of the former policy are not loaded, the policy is applied
+	if _, err := readSnapshot(); err == nil {
+		t.Errorf("readSnapshot() of another retention policy succeeded")
+	}
+	if err := loadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSnapshot(); err != nil {
+		t.Errorf("readSnapshot() after the policy change error: %s", err)
+	}
+	deleteExpiredPastes()
+	if _, err := store.GetPaste(pastes[0].Id); err != ErrNotFound {
+		t.Errorf("GetPaste(%q) of a burn paste after the policy change error == %v, want %v", pastes[0].Id, err, ErrNotFound)
+	}
+	if next, ok := nextExpiration(); !ok || !next.Equal(pastes[1].Postdate.Add(9000*time.Second)) {
+		t.Errorf("nextExpiration() == %s, %v, want the discussion end of retention", next, ok)
+	}
+}
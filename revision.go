@@ -0,0 +1,127 @@
+package bingo
+
+import (
+	"time"
+)
+
+/*
+A paste revision.
+
+Editing a paste keeps its previous data as a revision. Revisions are numbered
+from 0 (the data the paste was created with), the paste itself holding the
+data of its latest revision.
+
+ - Revision: revision number
+ - Data: paste (encrypted) data of this revision
+ - Postdate: revision creation date
+*/
+type Revision struct {
+	Revision int       `json:"revision"`
+	Data     string    `json:"data,omitempty"`
+	Postdate time.Time `json:"postdate"`
+}
+
+// RevisionsByNumber implements sort.Interface for []Revision based on the Revision field.
+type RevisionsByNumber []Revision
+
+func (a RevisionsByNumber) Len() int           { return len(a) }
+func (a RevisionsByNumber) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a RevisionsByNumber) Less(i, j int) bool { return a[i].Revision < a[j].Revision }
+
+// Latest revision of a paste, held by the paste itself.
+func (paste *Paste) latestRevision() Revision {
+	date := paste.Updated
+	if date.IsZero() {
+		date = paste.Postdate
+	}
+	return Revision{Revision: paste.Revision, Data: paste.Data, Postdate: date}
+}
+
+// Load all the revisions of a paste, the latest one included.
+func listRevisions(paste *Paste) ([]Revision, error) {
+	revisions, err := store.ListRevisions(paste)
+	if err != nil {
+		return nil, err
+	}
+	return append(revisions, paste.latestRevision()), nil
+}
+
+// Load a revision of a paste, the latest one included.
+func getRevision(paste *Paste, n int) (Revision, error) {
+	if n == paste.Revision {
+		return paste.latestRevision(), nil
+	}
+	if n < 0 || n > paste.Revision {
+		return Revision{}, ErrNotFound
+	}
+	return store.GetRevision(paste, n)
+}
+
+// Copy of a paste holding the data it was created with.
+// Delete tokens are computed from this data, so that they remain valid
+// when the paste is edited.
+func (paste *Paste) original() (Paste, error) {
+	original := *paste
+	if paste.Revision > 0 {
+		rev, err := store.GetRevision(paste, 0)
+		if err != nil {
+			return original, err
+		}
+		original.Data = rev.Data
+	}
+	return original, nil
+}
+
+// Replace the data of a paste, keeping its current data as a revision.
+// Room is made for the new data according to the quota. ErrExists is
+// returned if the paste was edited in the meantime.
+func revisePaste(paste *Paste, data string) error {
+	if hasQuota() {
+		quotaLock.Lock()
+		defer quotaLock.Unlock()
+		if err := makeRoom(int64(len(data)), 0, paste.Id); err != nil {
+			return err
+		}
+	}
+
+	// Creating the revision fails if another edit created it first
+	rev := paste.latestRevision()
+	if err := store.AddRevision(paste, &rev); err != nil {
+		return err
+	}
+
+	paste.Revision++
+	paste.Data = data
+	paste.Updated = time.Now()
+	if err := store.PutPaste(paste); err != nil {
+		return err
+	}
+
+	// Previous data is kept in the revision, so the paste grows by the new data
+	indexGrow(paste, int64(len(data)))
+	return nil
+}
+
+// Save a revision of a paste to the store and account for it in the index.
+// Room is made for the revision according to the quota, and ErrExists is
+// returned if the revision already exists.
+func saveRevision(paste *Paste, rev *Revision) error {
+	if hasQuota() {
+		quotaLock.Lock()
+		defer quotaLock.Unlock()
+		if err := makeRoom(rev.size(), 0, paste.Id); err != nil {
+			return err
+		}
+	}
+
+	if err := store.AddRevision(paste, rev); err != nil {
+		return err
+	}
+	indexGrow(paste, rev.size())
+	return nil
+}
+
+// Approximate storage size of a revision.
+func (rev *Revision) size() int64 {
+	return int64(len(rev.Data))
+}
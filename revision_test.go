@@ -0,0 +1,130 @@
+package bingo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send a request to a handler.
+func request(handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestEditPaste(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	initPatterns()
+
+	antiflood.m = make(map[string]time.Time)
+	w := post(`{"data":"First","expire":60}`)
+	var created Postresponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("POST response == %q: %s", w.Body.String(), err)
+	}
+
+	// Only the owner can edit
+	for _, wrong := range []string{strings.Repeat("0", 20), strings.Repeat("z", 20)} {
+		if w := request(handlerEdit, "POST", "/edit/"+created.Id+"/"+wrong, `{"data":"Hacked"}`); w.Code != http.StatusForbidden {
+			t.Errorf("POST /edit with wrong token %s status == %d, want %d", wrong, w.Code, http.StatusForbidden)
+		}
+	}
+
+	for i, data := range []string{"Second", "Third"} {
+		antiflood.m = make(map[string]time.Time)
+		w := request(handlerEdit, "POST", "/edit/"+created.Id+"/"+created.Delete, `{"data":"`+data+`"}`)
+		var edited Postresponse
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &edited) != nil || edited.Revision != i+1 {
+			t.Fatalf("POST /edit #%d == %d %q, want revision %d", i, w.Code, w.Body.String(), i+1)
+		}
+	}
+
+	paste, err := store.GetPaste(created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paste.Data != "Third" || paste.Revision != 2 {
+		t.Errorf("edited paste == %+v, want revision 2", paste)
+	}
+
+	// Editing a stale copy of the paste conflicts
+	stale := paste
+	stale.Revision = 1
+	if err := revisePaste(&stale, "Stale"); err != ErrExists {
+		t.Errorf("revisePaste(<stale paste>) error == %v, want %v", err, ErrExists)
+	}
+
+	// List revisions
+	w = request(handlerRevisions, "GET", "/revisions/"+created.Id, "")
+	var revisions []Revision
+	if err := json.Unmarshal(w.Body.Bytes(), &revisions); err != nil {
+		t.Fatalf("GET /revisions response == %q: %s", w.Body.String(), err)
+	}
+	if len(revisions) != 3 || revisions[0].Revision != 0 || revisions[2].Revision != 2 || revisions[0].Data != "" {
+		t.Errorf("GET /revisions == %+v, want revisions 0 to 2 without data", revisions)
+	}
+
+	// Fetch revisions
+	for n, data := range []string{"First", "Second", "Third"} {
+		w := request(handlerRevisions, "GET", "/revisions/"+created.Id+"/"+strconv.Itoa(n), "")
+		var rev Revision
+		if err := json.Unmarshal(w.Body.Bytes(), &rev); err != nil || rev.Revision != n || rev.Data != data {
+			t.Errorf("GET /revisions/%d == %q, want %q", n, w.Body.String(), data)
+		}
+	}
+	if w := request(handlerRevisions, "GET", "/revisions/"+created.Id+"/3", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /revisions/3 status == %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// The delete token remains valid after edits
+	if !validateToken(&paste, created.Delete) {
+		t.Errorf("validateToken(<edited paste>, %q) is false, want true", created.Delete)
+	}
+}
+
+func TestForgedToken(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	initPatterns()
+	conf.Views = "resources/views"
+	initTemplates()
+	conf.TrashGrace = 3600
+
+	antiflood.m = make(map[string]time.Time)
+	var created Postresponse
+	if err := json.Unmarshal(post(`{"data":"First","expire":60}`).Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers know the paste data, but not the server key
+	paste, err := store.GetPaste(created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := paste.hmac([]byte("secret"))
+
+	if w := request(handlerEdit, "POST", "/edit/"+created.Id+"/"+forged, `{"data":"pwned"}`); w.Code != http.StatusForbidden {
+		t.Errorf("POST /edit with a forged token status == %d, want %d", w.Code, http.StatusForbidden)
+	}
+	request(handlerRoot, "GET", "/delete/"+created.Id+"/"+forged, "")
+	if p, err := store.GetPaste(created.Id); err != nil || p.Data != "First" {
+		t.Errorf("GetPaste(%q) after forged edit and delete == %+v, %v, want the paste unchanged", created.Id, p, err)
+	}
+
+	request(handlerRoot, "GET", "/delete/"+created.Id+"/"+created.Delete, "")
+	if w := request(handlerUndelete, "POST", "/undelete/"+created.Id+"/"+forged, ""); w.Code != http.StatusForbidden {
+		t.Errorf("POST /undelete with a forged token status == %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if _, err := store.GetTrash(created.Id); err != nil {
+		t.Errorf("GetTrash(%q) after forged undelete error: %s", created.Id, err)
+	}
+}
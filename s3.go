@@ -0,0 +1,331 @@
+package bingo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+A backend storing records as objects of an S3-compatible bucket.
+
+Requests are signed with AWS signature version 4 and objects are addressed
+with path-style URLs (endpoint/bucket/key), which all S3-compatible servers
+support.
+
+ - endpoint: server URL, eg. https://s3.eu-west-1.amazonaws.com
+ - bucket: bucket name
+ - prefix: prefix of all object keys, eg. "bingo/"
+ - region: bucket region
+ - accessKey: access key id
+ - secretKey: secret access key
+ - client: HTTP client
+*/
+type s3Backend struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// Result of a ListObjectsV2 request.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// Error returned by S3 for unexpected responses.
+type s3Error struct {
+	status int
+	body   string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 error %d: %s", e.status, e.body)
+}
+
+// Create a new S3 backend.
+func newS3Backend(endpoint, bucket, prefix, region, accessKey, secretKey string) *s3Backend {
+	return &s3Backend{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// URI-encode a string as required by AWS signatures.
+// Slashes are kept when encoding paths.
+func s3Escape(s string, path bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// Compute a SHA256 HMAC.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sign a request with AWS signature version 4.
+func (b *s3Backend) sign(r *http.Request, payload []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	hash := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(hash[:])
+
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonical headers
+	headers := map[string]string{"host": r.URL.Host}
+	for name := range r.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "if-none-match" || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(r.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Canonical query string
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		params = append(params, s3Escape(k, false)+"="+s3Escape(query.Get(k), false))
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, signature))
+}
+
+// Send a signed request.
+// key is the record key, or an empty string for bucket requests.
+func (b *s3Backend) do(method, key string, query url.Values, payload []byte, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(b.endpoint + "/" + s3Escape(b.bucket, false) + "/")
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		u.RawPath = u.Path + s3Escape(b.prefix+key, true)
+		u.Path = u.Path + b.prefix + key
+	}
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+
+	r, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	b.sign(r, payload, time.Now())
+
+	return b.client.Do(r)
+}
+
+// Read a response body and convert error responses.
+func s3Response(resp *http.Response, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return nil, ErrExists
+	case resp.StatusCode >= 300:
+		return nil, &s3Error{resp.StatusCode, string(body)}
+	}
+	return body, nil
+}
+
+// Read an object.
+func (b *s3Backend) get(key string) ([]byte, error) {
+	return s3Response(b.do("GET", key, nil, nil, nil))
+}
+
+// Write a new object.
+// The write is conditional, so that it fails if the object already exists.
+func (b *s3Backend) create(key string, data []byte) error {
+	header := http.Header{}
+	header.Set("If-None-Match", "*")
+	_, err := s3Response(b.do("PUT", key, nil, data, header))
+	return err
+}
+
+// Write an object.
+func (b *s3Backend) put(key string, data []byte) error {
+	_, err := s3Response(b.do("PUT", key, nil, data, nil))
+	return err
+}
+
+// List object keys and common prefixes, following pagination.
+// fn is called with each page of results.
+func (b *s3Backend) listObjects(prefix, delimiter string, fn func(result *s3ListResult) error) error {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", b.prefix+prefix)
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		body, err := s3Response(b.do("GET", "", query, nil, nil))
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return err
+		}
+		for i := range result.Contents {
+			result.Contents[i].Key = strings.TrimPrefix(result.Contents[i].Key, b.prefix)
+		}
+
+		if err := fn(&result); err != nil {
+			return err
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Delete an object and every object stored below it.
+func (b *s3Backend) remove(key string) error {
+	keys := make([]string, 0)
+	err := b.listObjects(key, "", func(result *s3ListResult) error {
+		for _, c := range result.Contents {
+			if c.Key == key || strings.HasPrefix(c.Key, key+"/") {
+				keys = append(keys, c.Key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrNotFound
+	}
+
+	for _, k := range keys {
+		if _, err := s3Response(b.do("DELETE", k, nil, nil, nil)); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// List the objects stored below a name.
+func (b *s3Backend) list(name string) ([]string, error) {
+	names := make([]string, 0)
+	err := b.listObjects(name+"/", "/", func(result *s3ListResult) error {
+		for _, c := range result.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, name+"/"))
+		}
+		return nil
+	})
+	return names, err
+}
+
+// Call fn with the key of every top-level object.
+func (b *s3Backend) walk(fn func(key string) error) error {
+	return b.listObjects("", "/", func(result *s3ListResult) error {
+		for _, c := range result.Contents {
+			if err := fn(c.Key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Move an unreadable object below lost+found.
+func (b *s3Backend) quarantine(key string) error {
+	data, err := b.get(key)
+	if err != nil {
+		return err
+	}
+	dest := lostFound + "/" + strings.Replace(key, "/", "-", -1) + "." + time.Now().Format("20060102150405.000000000")
+	Loggers.Warn.Printf("Quarantine %s to %s", key, dest)
+	if err := b.put(dest, data); err != nil {
+		return err
+	}
+	_, err = s3Response(b.do("DELETE", key, nil, nil, nil))
+	return err
+}
@@ -0,0 +1,158 @@
+package bingo
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Number of keys listed per page by the fake S3 server.
+const fakeS3PageSize = 2
+
+// A fake S3 server keeping objects of a single bucket in memory.
+type fakeS3 struct {
+	sync.Mutex
+	t       *testing.T
+	bucket  string
+	objects map[string][]byte
+}
+
+type fakeS3ListResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") {
+		f.t.Errorf("%s %s: unexpected Authorization header %q", r.Method, r.URL, auth)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+f.bucket+"/")
+
+	switch {
+	case r.Method == "GET" && key == "":
+		f.list(w, r)
+	case r.Method == "GET":
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == "PUT":
+		if _, ok := f.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Answer a ListObjectsV2 request.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+	// Sorted keys and common prefixes
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		name := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				name = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	var result fakeS3ListResult
+	for i := start; i < len(names) && i < start+fakeS3PageSize; i++ {
+		if delimiter != "" && strings.HasSuffix(names[i], delimiter) {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{names[i]})
+		} else {
+			result.Contents = append(result.Contents, struct{ Key string }{names[i]})
+		}
+	}
+	if start+fakeS3PageSize < len(names) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + fakeS3PageSize)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3Store(t *testing.T) {
+	fake := &fakeS3{t: t, bucket: "bucket", objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// Objects of other applications share the bucket
+	fake.objects["other/object"] = []byte("other")
+
+	b := newS3Backend(server.URL, "bucket", "bingo/", "us-east-1", "access", "secret")
+	testStore(t, &recordStore{b: b})
+
+	// Deletes always succeed, view limits rely on store locks
+	testViewPaste(t, &recordStore{b: b})
+
+	// The other paste is stored as a metadata object and a blob object
+	if _, ok := fake.objects["other/object"]; !ok || len(fake.objects) != 3 {
+		t.Errorf("bucket objects after test == %d, want the other paste and the other object", len(fake.objects))
+	}
+}
+
+func TestS3Escape(t *testing.T) {
+	tests := []struct {
+		s    string
+		path bool
+		want string
+	}{
+		{"abc_/x", true, "abc_/x"},
+		{"abc_/x", false, "abc_%2Fx"},
+		{"lost+found", true, "lost%2Bfound"},
+		{"a b~", false, "a%20b~"},
+	}
+	for _, test := range tests {
+		if got := s3Escape(test.s, test.path); got != test.want {
+			t.Errorf("s3Escape(%q, %v) == %q, want %q", test.s, test.path, got, test.want)
+		}
+	}
+}
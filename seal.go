@@ -0,0 +1,172 @@
+package bingo
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Header of sealed records, followed by the key id, the nonce and the ciphertext.
+var sealMagic = []byte("BGS2")
+
+// Header of records sealed without their record key as additional data, read
+// until they are rewritten by "bingo rekey".
+var legacySealMagic = []byte("BGS1")
+
+// Size of key ids.
+const sealKeyIdSize = 4
+
+/*
+Seals stored records with server-side keys (AES-GCM).
+
+ - current: key sealing new records, nil to store records in clear
+ - currentId: id of the current key
+ - keys: keys opening records, by id
+*/
+type sealer struct {
+	current   cipher.AEAD
+	currentId string
+	keys      map[string]cipher.AEAD
+}
+
+// Parse a base64 encoded AES key.
+// Returns the key id and the AEAD cipher.
+func parseSealKey(key string) (string, cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid encryption key: %s", err)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid encryption key: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, err
+	}
+	hash := sha256.Sum256(raw)
+	return string(hash[:sealKeyIdSize]), aead, nil
+}
+
+// Create a sealer from the current key and older keys still used to open records.
+// No sealer is returned when no key is given.
+func newSealer(current string, old []string) (*sealer, error) {
+	if current == "" && len(old) == 0 {
+		return nil, nil
+	}
+
+	s := &sealer{keys: make(map[string]cipher.AEAD)}
+	for _, key := range old {
+		id, aead, err := parseSealKey(key)
+		if err != nil {
+			return nil, err
+		}
+		s.keys[id] = aead
+	}
+	if current != "" {
+		id, aead, err := parseSealKey(current)
+		if err != nil {
+			return nil, err
+		}
+		s.keys[id] = aead
+		s.current, s.currentId = aead, id
+	}
+	return s, nil
+}
+
+// Check whether data is sealed.
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealMagic) || bytes.HasPrefix(data, legacySealMagic)
+}
+
+// Additional data of a record, its header followed by its record key, so that
+// a sealed record cannot be opened under another key.
+func sealData(header []byte, key string) []byte {
+	ad := make([]byte, 0, len(header)+len(key))
+	ad = append(ad, header...)
+	return append(ad, key...)
+}
+
+// Seal the data of the record stored under key with the current key.
+// Data is returned as is without a current key.
+func (s *sealer) seal(key string, data []byte) ([]byte, error) {
+	if s == nil || s.current == nil {
+		return data, nil
+	}
+
+	nonce := make([]byte, s.current.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(sealMagic)+sealKeyIdSize+len(nonce))
+	header = append(header, sealMagic...)
+	header = append(header, s.currentId...)
+	header = append(header, nonce...)
+
+	// The header and the record key are authenticated as additional data
+	return s.current.Seal(header, nonce, data, sealData(header, key)), nil
+}
+
+// Open the sealed data of the record stored under key with the key that
+// sealed it. Data which is not sealed is returned as is.
+func (s *sealer) open(key string, data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	if s == nil {
+		return nil, &configError{"record is encrypted but no encryption key is configured"}
+	}
+
+	if len(data) < len(sealMagic)+sealKeyIdSize {
+		return nil, errors.New("truncated encrypted record")
+	}
+	id := string(data[len(sealMagic) : len(sealMagic)+sealKeyIdSize])
+	aead, ok := s.keys[id]
+	if !ok {
+		return nil, &configError{"record is encrypted with an unknown key"}
+	}
+
+	n := len(sealMagic) + sealKeyIdSize + aead.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("truncated encrypted record")
+	}
+	header := data[:n]
+	nonce := data[len(sealMagic)+sealKeyIdSize : n]
+	ad := sealData(header, key)
+	if bytes.HasPrefix(data, legacySealMagic) {
+		// Legacy record, only its header is authenticated
+		ad = header
+	}
+	return aead.Open(nil, nonce, data[n:], ad)
+}
+
+// Rekey rewrites every stored record with the current encryption key of the
+// configuration, so that old keys can then be removed from it, and so that
+// records sealed before their record key was authenticated are bound to it.
+// Records are also rewritten with the current compression.
+// The server must be stopped while records are rewritten.
+func Rekey(file string) (int, error) {
+	if err := setup(file); err != nil {
+		return 0, err
+	}
+	s, err := openStore()
+	if err != nil {
+		return 0, err
+	}
+	rs, ok := s.(*recordStore)
+	if !ok {
+		return 0, errors.New("store records cannot be rewritten")
+	}
+
+	Loggers.Info.Println("Rewrite stored records with the current encryption key")
+	n, err := rs.rewrite()
+	Loggers.Info.Printf("%d records rewritten", n)
+	return n, err
+}
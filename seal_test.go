@@ -0,0 +1,169 @@
+package bingo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Keys for tests.
+var (
+	testKey1 = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	testKey2 = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 16))
+)
+
+func TestSealedStore(t *testing.T) {
+	sealer, err := newSealer(testKey1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newMemoryStore()
+	s.sealer = sealer
+	testStore(t, s)
+}
+
+func TestRekey(t *testing.T) {
+	s := newMemoryStore()
+	paste := newPaste("Awesome paste")
+	if err := s.CreatePaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+	comment := newComment("Comment", nil)
+	if err := s.AppendComment(&paste, &comment); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keys := range []struct {
+		current string
+		old     []string
+	}{
+		// Encrypt a clear store
+		{testKey1, nil},
+		// Rotate keys
+		{testKey2, []string{testKey1}},
+		// Decrypt the store
+		{"", []string{testKey2}},
+	} {
+		sealer, err := newSealer(keys.current, keys.old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.sealer = sealer
+		// Paste metadata, paste blob and comment
+		if n, err := s.rewrite(); err != nil || n != 3 {
+			t.Fatalf("rewrite() == %d, %v, want 3 records", n, err)
+		}
+
+		data, _ := s.b.get(paste.Id)
+		if isSealed(data) != (keys.current != "") {
+			t.Errorf("paste record sealed == %v after rewrite with key %q", isSealed(data), keys.current)
+		}
+
+		// Records can be read with the current key only
+		s.sealer, _ = newSealer(keys.current, nil)
+		if p, err := s.GetPaste(paste.Id); err != nil || p.Data != paste.Data {
+			t.Errorf("GetPaste() == %+v, %v after rewrite with key %q", p, err, keys.current)
+		}
+		if c, err := s.GetComment(&paste, comment.Id); err != nil || c.Data != comment.Data {
+			t.Errorf("GetComment() == %+v, %v after rewrite with key %q", c, err, keys.current)
+		}
+	}
+
+	// Tampered records cannot be read
+	s.sealer, _ = newSealer(testKey1, nil)
+	s.PutPaste(&paste)
+	data, _ := s.b.get(paste.Id)
+	data[len(data)-1] ^= 1
+	s.b.put(paste.Id, data)
+	if _, err := s.GetPaste(paste.Id); err == nil {
+		t.Errorf("GetPaste() of a tampered record succeeded")
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+
+	s := newFileStore(root, 2)
+	s.sealer, _ = newSealer(testKey1, nil)
+	paste := newPaste("Awesome paste")
+	if err := s.CreatePaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", testKey2} {
+		s.sealer, _ = newSealer(key, nil)
+		if err := s.WalkMeta(func(*Paste, int64) error { return nil }); err == nil {
+			t.Errorf("WalkMeta() with key %q succeeded", key)
+		}
+		if _, err := fsckFolder(s, true, ioutil.Discard); err == nil {
+			t.Errorf("fsckFolder() with key %q succeeded", key)
+		}
+	}
+
+	// Records are not quarantined
+	s.sealer, _ = newSealer(testKey1, nil)
+	if p, err := s.GetPaste(paste.Id); err != nil || p.Data != paste.Data {
+		t.Errorf("GetPaste() == %+v, %v, want the paste back with its key", p, err)
+	}
+}
+
+func TestSealedRecordKey(t *testing.T) {
+	s := newMemoryStore()
+	s.sealer, _ = newSealer(testKey1, nil)
+	pastes := []Paste{newPaste("Awesome paste"), newPaste("Other paste")}
+	for i := range pastes {
+		if err := s.CreatePaste(&pastes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Records copied under the key of another paste cannot be read
+	for _, key := range []string{blobKey(pastes[0].Id), pastes[0].Id} {
+		data, _ := s.b.get(key)
+		other := pastes[1].Id
+		if key != pastes[0].Id {
+			other = blobKey(other)
+		}
+		s.b.put(other, data)
+		if p, err := s.GetPaste(pastes[1].Id); err == nil {
+			t.Errorf("GetPaste() with record %s copied == %+v, want an error", key, p)
+		}
+	}
+
+	// Legacy records, sealed without their record key, are read until rekeyed
+	paste := newPaste("Legacy paste")
+	if err := s.CreatePaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{paste.Id, blobKey(paste.Id)} {
+		data, _ := s.b.get(key)
+		data, err := s.sealer.open(key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.b.put(key, legacySeal(t, data))
+	}
+	if p, err := s.GetPaste(paste.Id); err != nil || p.Data != paste.Data {
+		t.Errorf("GetPaste() of a legacy record == %+v, %v", p, err)
+	}
+	if _, err := s.rewritePaste(paste.Id); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := s.b.get(paste.Id); !bytes.HasPrefix(data, sealMagic) {
+		t.Errorf("legacy record was not sealed again with its record key")
+	}
+}
+
+// Seal data the legacy way, with the header as only additional data.
+func legacySeal(t *testing.T, data []byte) []byte {
+	id, aead, err := parseSealKey(testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := append(append(append([]byte{}, legacySealMagic...), id...), make([]byte, aead.NonceSize())...)
+	nonce := header[len(header)-aead.NonceSize():]
+	return aead.Seal(header, nonce, data, header)
+}
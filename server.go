@@ -1,15 +1,23 @@
 package bingo
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -18,24 +26,68 @@ Postdata contains the json data sent by the client.
 
  - Data: paste (encrypted) data
  - Author: author (encrypted)
- - Expire: expiration date
- - Burn: whether this paste must be deleted once read
+ - Expire: number of seconds before the paste expires, 0 if it never expires (see Conf.NeverExpire)
+ - ExpireAfterView: number of seconds the paste is kept after its first view, 0 for no limit
+ - Burn: whether this paste must be deleted once read, same as MaxViews 1
+ - MaxViews: number of views before the paste is deleted, 0 for no limit
  - Highlight: whether to enable syntax highlighting
  - Discussion: whether discussions are enabled
  - Paste: parent paste, if any (for comments)
  - Parent: parent comment, if any (for comments)
  - Comments: whether this is a comment (true) or a regular paste (false)
+ - Attachments: files attached to the paste, with their (encrypted) name and data
 */
 type Postdata struct {
-	Data       string `json:"data"`
-	Author     string `json:"author"`
-	Expire     int    `json:"expire"`
-	Burn       bool   `json:"burn"`
-	Highlight  bool   `json:"highlight"`
-	Discussion bool   `json:"discussion"`
-	Paste      string `json="paste"`
-	Parent     string `json="parent"`
-	Comment    bool   `json="comment"`
+	Data            string       `json:"data"`
+	Author          string       `json:"author"`
+	Expire          int          `json:"expire"`
+	ExpireAfterView int          `json:"expireafterview"`
+	Burn            bool         `json:"burn"`
+	MaxViews        int          `json:"maxviews"`
+	Highlight       bool         `json:"highlight"`
+	Discussion      bool         `json:"discussion"`
+	Paste           string       `json:"paste"`
+	Parent          string       `json:"parent"`
+	Comment         bool         `json:"comment"`
+	Attachments     []Attachment `json:"attachments"`
+}
+
+// Room left in a post body for the json envelope around data and author.
+const postEnvelopeSize = 4096
+
+// Maximum size of a post body.
+func maxPostSize() int64 {
+	max := conf.MaxPasteSize + int64(conf.MaxAttachments)*(conf.MaxAttachmentSize+maxAttachmentNameSize)
+	if conf.MaxCommentSize+conf.MaxAuthorSize > max {
+		max = conf.MaxCommentSize + conf.MaxAuthorSize
+	}
+	return max + postEnvelopeSize
+}
+
+// Check posted data sizes against the configured limits.
+// Returns an error message, or an empty string when sizes are fine.
+func (data *Postdata) checkSize() string {
+	if data.Comment {
+		if int64(len(data.Data)) > conf.MaxCommentSize {
+			return fmt.Sprintf("Comment is too large (%d bytes, max %d)", len(data.Data), conf.MaxCommentSize)
+		}
+		if int64(len(data.Author)) > conf.MaxAuthorSize {
+			return fmt.Sprintf("Author is too large (%d bytes, max %d)", len(data.Author), conf.MaxAuthorSize)
+		}
+	} else if int64(len(data.Data)) > conf.MaxPasteSize {
+		return fmt.Sprintf("Paste is too large (%d bytes, max %d)", len(data.Data), conf.MaxPasteSize)
+	} else if len(data.Attachments) > conf.MaxAttachments {
+		return fmt.Sprintf("Too many attachments (%d, max %d)", len(data.Attachments), conf.MaxAttachments)
+	}
+	for _, a := range data.Attachments {
+		if int64(len(a.Data)) > conf.MaxAttachmentSize {
+			return fmt.Sprintf("Attachment is too large (%d bytes, max %d)", len(a.Data), conf.MaxAttachmentSize)
+		}
+		if len(a.Name) > maxAttachmentNameSize {
+			return fmt.Sprintf("Attachment name is too large (%d bytes, max %d)", len(a.Name), maxAttachmentNameSize)
+		}
+	}
+	return ""
 }
 
 /*
@@ -46,6 +98,7 @@ Postresponse contains the json response sent to the client.
  - Expire: expiration date
  - Delete: delete token
  - Avatar: author's avatar (comments only)
+ - Revision: paste revision number (edits only)
 */
 type Postresponse struct {
 	Id       string    `json:"id"`
@@ -53,6 +106,34 @@ type Postresponse struct {
 	Expire   time.Time `json:"expire"`
 	Delete   string    `json:"delete"`
 	Avatar   string    `json:"avatar"`
+	Revision int       `json:"revision"`
+}
+
+/*
+Paste metadata, sent without the paste data (eg. before revealing a paste with a view limit).
+
+ - Id: paste id
+ - Postdate: paste creation date
+ - Expire: expiration date, brought forward by the first view for pastes expiring after their first view
+ - ExpireAfterView: number of seconds the paste is kept after its first view, 0 for no limit
+ - Burn: whether this paste is deleted once read
+ - MaxViews: number of views before the paste is deleted, 0 for no limit
+ - Remaining: number of views left, for pastes with a view limit
+ - Discussion: whether discussions are enabled
+ - Highlight: whether syntax highlighting is enabled
+ - Attachments: number of attached files
+*/
+type PasteMeta struct {
+	Id              string    `json:"id"`
+	Postdate        time.Time `json:"postdate"`
+	Expire          time.Time `json:"expire"`
+	ExpireAfterView int       `json:"expireafterview"`
+	Burn            bool      `json:"burn"`
+	MaxViews        int       `json:"maxviews"`
+	Remaining       int       `json:"remaining"`
+	Discussion      bool      `json:"discussion"`
+	Highlight       bool      `json:"highlight"`
+	Attachments     int       `json:"attachments"`
 }
 
 /*
@@ -72,13 +153,73 @@ Holds template data.
  - Paste: paste object
  - JPaste: marshaled paste
  - Deleted: true if the paste has been deleted
+ - Undelete: path restoring the deleted paste from the trash, if any
+ - Reveal: true if the paste (with a view limit) is only sent once the reader asks for it
  - Code: error code
+ - Lifetimes: paste lifetimes offered in the paste form
 */
 type TemplateData struct {
-	Paste   Paste
-	JPaste  string
-	Deleted bool
-	Code    int
+	Paste     Paste
+	JPaste    string
+	Deleted   bool
+	Undelete  string
+	Reveal    bool
+	Code      int
+	Lifetimes []Lifetime
+}
+
+/*
+A paste lifetime offered in the paste form.
+
+ - Seconds: lifetime in seconds, 0 if the paste never expires
+ - Label: lifetime description
+*/
+type Lifetime struct {
+	Seconds int
+	Label   string
+}
+
+// Units of paste lifetime labels, longest first.
+var lifetimeUnits = []struct {
+	seconds int
+	name    string
+}{
+	{31536000, "year"},
+	{2592000, "month"},
+	{604800, "week"},
+	{86400, "day"},
+	{3600, "hour"},
+	{60, "minute"},
+	{1, "second"},
+}
+
+// Describe a paste lifetime, in the longest unit dividing it (eg. "5 minutes").
+func lifetimeLabel(seconds int) string {
+	if seconds == 0 {
+		return "Never"
+	}
+	for _, unit := range lifetimeUnits {
+		if seconds%unit.seconds == 0 {
+			n := seconds / unit.seconds
+			if n == 1 {
+				return "1 " + unit.name
+			}
+			return fmt.Sprintf("%d %ss", n, unit.name)
+		}
+	}
+	return ""
+}
+
+// Paste lifetimes allowed by the configuration.
+func lifetimes() []Lifetime {
+	choices := make([]Lifetime, 0, len(conf.ExpireChoices)+1)
+	for _, seconds := range conf.ExpireChoices {
+		choices = append(choices, Lifetime{seconds, lifetimeLabel(seconds)})
+	}
+	if conf.allowNeverExpire() {
+		choices = append(choices, Lifetime{0, lifetimeLabel(0)})
+	}
+	return choices
 }
 
 // Templates map.
@@ -87,11 +228,24 @@ var templates map[string]*template.Template
 // URL patterns
 var regexGetPaste *regexp.Regexp
 var regexDeletePaste *regexp.Regexp
-
-func init() {
-	// Initialize URL patterns
-	regexGetPaste = regexp.MustCompile("^/([A-Za-z0-9]{20})$")
-	regexDeletePaste = regexp.MustCompile("^/delete/([A-Za-z0-9]{20})/([A-Za-z0-9]{20})$")
+var regexEditPaste *regexp.Regexp
+var regexUndeletePaste *regexp.Regexp
+var regexRevisions *regexp.Regexp
+var regexAttachment *regexp.Regexp
+var regexMeta *regexp.Regexp
+var regexReveal *regexp.Regexp
+
+// Initialize URL patterns according to the configured id format
+func initPatterns() {
+	id := idPattern()
+	regexGetPaste = regexp.MustCompile("^/(" + id + ")$")
+	regexDeletePaste = regexp.MustCompile("^/delete/(" + id + ")/([A-Za-z0-9]{20})$")
+	regexEditPaste = regexp.MustCompile("^/edit/(" + id + ")/([A-Za-z0-9]{20})$")
+	regexUndeletePaste = regexp.MustCompile("^/undelete/(" + id + ")/([A-Za-z0-9]{20})$")
+	regexRevisions = regexp.MustCompile("^/revisions/(" + id + ")(?:/([0-9]+))?$")
+	regexAttachment = regexp.MustCompile("^/attachment/(" + id + ")/(" + id + ")$")
+	regexMeta = regexp.MustCompile("^/meta/(" + id + ")$")
+	regexReveal = regexp.MustCompile("^/reveal/(" + id + ")$")
 }
 
 // Load templates on program initialisation
@@ -123,6 +277,7 @@ func renderTemplate(w http.ResponseWriter, name string, data TemplateData) error
 		return fmt.Errorf("The template %s does not exist.", name)
 	}
 
+	data.Lifetimes = lifetimes()
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	return tmpl.Execute(w, data)
 }
@@ -166,6 +321,460 @@ func getIP(r *http.Request) string {
 	return ip
 }
 
+// Read and check the json data of a post request.
+// An error response is sent and false is returned when data is invalid.
+func readPostdata(w http.ResponseWriter, r *http.Request) (Postdata, bool) {
+	var data Postdata
+
+	// Content-Type must be application/json
+	contentType := r.Header.Get("Content-Type")
+	matchJson, contentTypeErr := regexp.MatchString("application/json.*", contentType)
+	// TODO support charset
+
+	if contentTypeErr != nil {
+		Loggers.Warn.Println("Cannot detect Content-Type", contentTypeErr)
+		renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "Cannot detect content-type")
+		return data, false
+	}
+
+	if !matchJson {
+		Loggers.Warn.Println("Wrong Content-Type, expecting application/json, got", contentType)
+		renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "Wrong content-type")
+		return data, false
+	}
+
+	// Parse body, reading no more than the largest allowed post
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostSize()))
+	decodeErr := decoder.Decode(&data)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(decodeErr, &maxBytesErr) {
+		Loggers.Warn.Printf("Request body exceeds %d bytes", maxBytesErr.Limit)
+		renderAjaxError(w, http.StatusRequestEntityTooLarge, http.StatusRequestEntityTooLarge, "Request is too large")
+		return data, false
+	}
+	if decodeErr != nil {
+		Loggers.Error.Printf("Cannot parse json data: %s", decodeErr)
+		renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "Cannot parse request body")
+		return data, false
+	}
+
+	// Check data sizes
+	if message := data.checkSize(); message != "" {
+		Loggers.Warn.Println(message)
+		renderAjaxError(w, http.StatusRequestEntityTooLarge, http.StatusRequestEntityTooLarge, message)
+		return data, false
+	}
+	if data.MaxViews < 0 {
+		renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "View limit must be positive")
+		return data, false
+	}
+	if data.ExpireAfterView < 0 {
+		renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "Expiration delay must be positive")
+		return data, false
+	}
+	for _, a := range data.Attachments {
+		if a.Data == "" {
+			renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "Attachments cannot be empty")
+			return data, false
+		}
+	}
+
+	return data, true
+}
+
+// Name of the file holding the generated secret key of delete tokens, in the data folder.
+const tokenKeyFile = "token.key"
+
+// Secret key of delete tokens, see loadTokenKey.
+var tokenKey []byte
+
+// Load the secret key of delete tokens from the configuration, or from the
+// data folder, generating it on first start.
+func loadTokenKey() error {
+	if conf.TokenKey != "" {
+		tokenKey = []byte(conf.TokenKey)
+		return nil
+	}
+
+	p := filepath.Join(conf.Root, tokenKeyFile)
+	key, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		Loggers.Info.Printf("Generate delete token key %s", p)
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		key = []byte(hex.EncodeToString(random))
+		err = writeFile(p, key, 0600, true)
+		if err == ErrExists {
+			// Generated by another process meanwhile
+			key, err = ioutil.ReadFile(p)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("empty delete token key %s", p)
+	}
+	tokenKey = key
+	return nil
+}
+
+// Compute the delete token of a new paste.
+func deleteToken(paste *Paste) string {
+	if len(tokenKey) == 0 {
+		panic(errors.New("delete token key is not loaded"))
+	}
+	return paste.hmac(tokenKey)
+}
+
+// Validate the delete token of a paste.
+// Tokens are computed from the data the paste was created with.
+func validateToken(paste *Paste, token string) bool {
+	if len(tokenKey) == 0 {
+		Loggers.Error.Printf("Delete token key is not loaded")
+		return false
+	}
+	original, err := paste.original()
+	if err != nil {
+		Loggers.Error.Printf("Cannot load original revision of paste %s: %s", paste.Id, err)
+		return false
+	}
+	return original.hmacValidate(token, tokenKey)
+}
+
+// Load a paste which has not expired.
+// An error response is sent and false is returned otherwise.
+func loadPaste(w http.ResponseWriter, id string) (Paste, bool) {
+	paste, err := store.GetPaste(id)
+	if err != nil {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Paste not found")
+		return paste, false
+	}
+	if paste.hasExpired() {
+		Loggers.Info.Printf("Paste %s has expired on %s, delete", paste.Id, paste.expiration())
+		if err := deletePaste(paste.Id); err != nil {
+			Loggers.Error.Printf("Cannot delete paste %s: %s", paste.Id, err)
+		}
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Paste not found")
+		return paste, false
+	}
+	return paste, true
+}
+
+// Send a json response.
+func renderJson(w http.ResponseWriter, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		Loggers.Error.Printf("Marshal error: %s", err)
+		renderAjaxError(w, http.StatusInternalServerError, http.StatusInternalServerError, "Marshal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "%s", j)
+}
+
+// Handle edit requests: the owner of a paste posts a new revision of its data.
+func handlerEdit(w http.ResponseWriter, r *http.Request) {
+	match := regexEditPaste.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "POST" {
+		renderAjaxError(w, http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id, token := match[1], match[2]
+
+	data, ok := readPostdata(w, r)
+	if !ok {
+		return
+	}
+	if data.Comment {
+		renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "Comments cannot be edited")
+		return
+	}
+
+	paste, ok := loadPaste(w, id)
+	if !ok {
+		return
+	}
+
+	if !validateToken(&paste, token) {
+		Loggers.Warn.Println("Cannot validate token", token)
+		renderAjaxError(w, http.StatusForbidden, http.StatusForbidden, "Wrong delete token")
+		return
+	}
+
+	// Check that user is not flooding
+	if isFlood(getIP(r)) {
+		Loggers.Warn.Println("Flood deteted")
+		renderAjaxError(w, http.StatusForbidden, http.StatusForbidden, "Please wait before posting again")
+		return
+	}
+
+	if err := revisePaste(&paste, data.Data); err == ErrQuota {
+		renderAjaxError(w, http.StatusInsufficientStorage, http.StatusInsufficientStorage, "Storage quota exceeded, please try again later")
+		return
+	} else if err == ErrExists {
+		renderAjaxError(w, http.StatusConflict, http.StatusConflict, "Paste was edited in the meantime, please reload it")
+		return
+	} else if err == ErrNotFound {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Paste not found")
+		return
+	} else if err != nil {
+		Loggers.Error.Printf("Unable to edit paste %s: %s", paste.Id, err)
+		renderAjaxError(w, http.StatusInternalServerError, http.StatusInternalServerError, "Could not edit paste")
+		return
+	}
+
+	// Update antiflood
+	updateFlood(getIP(r))
+
+	renderJson(w, Postresponse{
+		Id:       paste.Id,
+		Postdate: paste.Updated,
+		Expire:   paste.Expire,
+		Delete:   token,
+		Revision: paste.Revision,
+	})
+}
+
+// Handle undelete requests: the owner of a deleted paste restores it from the
+// trash during its grace period.
+func handlerUndelete(w http.ResponseWriter, r *http.Request) {
+	match := regexUndeletePaste.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "POST" {
+		renderAjaxError(w, http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id, token := match[1], match[2]
+
+	paste, err := store.GetTrash(id)
+	if err != nil || expiresBefore(paste.cleanDate(), time.Now()) {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Paste not found in the trash")
+		return
+	}
+
+	if !validateToken(&paste, token) {
+		Loggers.Warn.Println("Cannot validate token", token)
+		renderAjaxError(w, http.StatusForbidden, http.StatusForbidden, "Wrong delete token")
+		return
+	}
+
+	// Expired pastes stay in the trash until purged
+	if expiresBefore(retainedUntil(&paste, paste.size()), time.Now()) {
+		renderAjaxError(w, http.StatusGone, http.StatusGone, "Paste has expired")
+		return
+	}
+
+	restored, err := restorePaste(id)
+	if err == ErrNotFound {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Paste not found in the trash")
+		return
+	} else if err != nil {
+		Loggers.Error.Printf("Cannot restore paste %s: %s", id, err)
+		renderAjaxError(w, http.StatusInternalServerError, http.StatusInternalServerError, "Could not restore paste")
+		return
+	}
+
+	renderJson(w, Postresponse{
+		Id:       restored.Id,
+		Postdate: restored.Postdate,
+		Expire:   restored.expiration(),
+		Delete:   token,
+		Revision: restored.Revision,
+	})
+}
+
+// Handle revision requests: list the revisions of a paste, or load one of them.
+func handlerRevisions(w http.ResponseWriter, r *http.Request) {
+	match := regexRevisions.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "GET" {
+		renderAjaxError(w, http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	paste, ok := loadPaste(w, match[1])
+	if !ok {
+		return
+	}
+
+	// Reading revisions would not count as a view
+	if paste.viewLimit() > 0 {
+		renderAjaxError(w, http.StatusForbidden, http.StatusForbidden, "Pastes with a view limit have no revisions")
+		return
+	}
+
+	if match[2] == "" {
+		// List revisions, without their data
+		revisions, err := listRevisions(&paste)
+		if err != nil {
+			Loggers.Error.Printf("Cannot load revisions of paste %s: %s", paste.Id, err)
+			renderAjaxError(w, http.StatusInternalServerError, http.StatusInternalServerError, "Cannot load revisions")
+			return
+		}
+		for i := range revisions {
+			revisions[i].Data = ""
+		}
+		renderJson(w, revisions)
+		return
+	}
+
+	n, err := strconv.Atoi(match[2])
+	if err != nil {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Revision not found")
+		return
+	}
+	rev, err := getRevision(&paste, n)
+	if err == ErrNotFound {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Revision not found")
+		return
+	} else if err != nil {
+		Loggers.Error.Printf("Cannot load revision %d of paste %s: %s", n, paste.Id, err)
+		renderAjaxError(w, http.StatusInternalServerError, http.StatusInternalServerError, "Cannot load revision")
+		return
+	}
+	renderJson(w, rev)
+}
+
+// Handle attachment requests: load an attachment of a paste, with its data.
+func handlerAttachment(w http.ResponseWriter, r *http.Request) {
+	match := regexAttachment.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "GET" {
+		renderAjaxError(w, http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Paste data is not needed
+	paste, _, err := store.GetMeta(match[1])
+	if err != nil || paste.hasExpired() {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Paste not found")
+		return
+	}
+
+	// Attachments of pastes with a view limit are sent along with the paste
+	if paste.viewLimit() > 0 {
+		renderAjaxError(w, http.StatusForbidden, http.StatusForbidden, "Attachments of pastes with a view limit are sent with the paste")
+		return
+	}
+
+	attachment, err := store.GetAttachment(&paste, match[2])
+	if err == ErrNotFound {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Attachment not found")
+		return
+	} else if err != nil {
+		Loggers.Error.Printf("Cannot load attachment %s of paste %s: %s", match[2], paste.Id, err)
+		renderAjaxError(w, http.StatusInternalServerError, http.StatusInternalServerError, "Cannot load attachment")
+		return
+	}
+	renderJson(w, attachment)
+}
+
+// Load the metadata of a paste which has not expired.
+// An error response is sent and false is returned otherwise.
+func loadMeta(w http.ResponseWriter, id string) (Paste, bool) {
+	paste, _, err := store.GetMeta(id)
+	if err != nil {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Paste not found")
+		return paste, false
+	}
+	if paste.hasExpired() {
+		Loggers.Info.Printf("Paste %s has expired on %s, delete", paste.Id, paste.expiration())
+		if err := deletePaste(paste.Id); err != nil {
+			Loggers.Error.Printf("Cannot delete paste %s: %s", paste.Id, err)
+		}
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Paste not found")
+		return paste, false
+	}
+	return paste, true
+}
+
+// Handle metadata requests: send the metadata of a paste, without its data.
+func handlerMeta(w http.ResponseWriter, r *http.Request) {
+	match := regexMeta.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "GET" {
+		renderAjaxError(w, http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	paste, ok := loadMeta(w, match[1])
+	if !ok {
+		return
+	}
+	renderJson(w, PasteMeta{
+		Id:              paste.Id,
+		Postdate:        paste.Postdate,
+		Expire:          paste.expiration(),
+		ExpireAfterView: paste.ExpireAfterView,
+		Burn:            paste.Burn,
+		MaxViews:        paste.viewLimit(),
+		Remaining:       paste.remainingViews(),
+		Discussion:      paste.Discussion,
+		Highlight:       paste.Highlight,
+		Attachments:     len(paste.Attachments),
+	})
+}
+
+// Handle reveal requests: send a paste with a view limit along with its
+// attachments, and count a view. Reveals are posted by the page script, so
+// that fetching the paste URL (eg. for a link preview) does not count as a
+// view.
+func handlerReveal(w http.ResponseWriter, r *http.Request) {
+	match := regexReveal.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "POST" {
+		renderAjaxError(w, http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	meta, ok := loadMeta(w, match[1])
+	if !ok {
+		return
+	}
+	if meta.viewLimit() == 0 {
+		renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "Only pastes with a view limit are revealed")
+		return
+	}
+
+	// Count the view, the paste is deleted on its last view
+	paste, err := viewPaste(meta.Id)
+	if err == ErrNotFound {
+		renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Paste not found")
+		return
+	} else if err != nil {
+		Loggers.Error.Printf("Cannot count view of paste %s: %s", meta.Id, err)
+		renderAjaxError(w, http.StatusInternalServerError, http.StatusInternalServerError, "Cannot load paste")
+		return
+	}
+	Loggers.Info.Printf("Paste %s viewed, %d views left", paste.Id, paste.remainingViews())
+	paste.Expire = paste.expiration()
+	paste.Hold = nil
+	renderJson(w, paste)
+}
+
 // Handle root requests
 func handlerRoot(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -176,8 +785,8 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 			// Extract paste id from URL
 			id := regexGetPaste.FindStringSubmatch(r.URL.Path)
 
-			// Load paste from disk
-			paste, err := loadPaste(id[1])
+			// Load paste from store
+			paste, err := store.GetPaste(id[1])
 			if err != nil {
 				renderError(w, 404, "Not found")
 				return
@@ -188,8 +797,8 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 
 			// Has this paste expired ?
 			if paste.hasExpired() {
-				Loggers.Info.Printf("Paste %s has expired on %s, delete", paste.Id, paste.Expire)
-				if err := paste.del(); err != nil {
+				Loggers.Info.Printf("Paste %s has expired on %s, delete", paste.Id, paste.expiration())
+				if err := deletePaste(paste.Id); err != nil {
 					Loggers.Error.Printf("Cannot delete paste %s: %s", paste.Id, err)
 				}
 
@@ -198,20 +807,44 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			// Should this paste be deleted after reading ?
-			if paste.Burn {
-				Loggers.Info.Printf("Burn paste %s after reading", paste.Id)
-				if err := paste.del(); err != nil {
-					Loggers.Error.Printf("Cannot delete paste %s: %s", paste.Id, err)
+			// Should this paste be deleted after some views ?
+			// Its data is only sent once the reader asks for it (see handlerReveal)
+			if paste.viewLimit() > 0 {
+				paste.Data = ""
+				data.Paste = paste
+				data.Reveal = true
+				if renderErr := render(w, data); renderErr != nil {
+					Loggers.Error.Printf("Cannot render template for paste %s: %s", paste.Id, renderErr)
+					renderError(w, 500, "Render error")
+				}
+				return
+			}
+
+			// Start the expiration delay of pastes expiring after their first view
+			if paste.countsViews() {
+				viewed, err := viewPaste(paste.Id)
+				if err == ErrNotFound {
+					// Deleted in the meantime
+					renderError(w, 404, "Not found")
+					return
+				} else if err != nil {
+					Loggers.Error.Printf("Cannot save first view of paste %s: %s", paste.Id, err)
+					renderError(w, 500, "Server error")
+					return
 				}
+				paste.FirstView = viewed.FirstView
 			}
+			paste.Expire = paste.expiration()
+			paste.Hold = nil
 
 			// If paste discussion is enabled, load comments
 			if paste.Discussion {
-				if err := paste.loadComments(); err != nil {
+				comments, err := store.ListComments(&paste)
+				if err != nil {
 					Loggers.Error.Printf("Cannot load comments of paste %s: %s", paste.Id, err)
 					// TODO error
 				}
+				paste.Comments = comments
 
 				// Marshall comments
 				cc := make([]string, len(paste.Comments))
@@ -250,28 +883,49 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 			id, token := match[1], match[2]
 			Loggers.Info.Println("Delete paste", id, token)
 
-			// Load paste from disk
-			paste, err := loadPaste(id)
+			// Load paste from store
+			paste, err := store.GetPaste(id)
 			if err != nil {
 				renderError(w, 404, "Not found")
 				return
 			}
 
 			// Validate delete token
-			// TODO server's secret
-			if !paste.hmacValidate(token, []byte("secret")) {
+			if !validateToken(&paste, token) {
 				Loggers.Warn.Println("Cannot validate token", token)
 				renderError(w, 403, "Wrong delete token")
 				return
 			}
 
-			if deleteErr := paste.del(); err != nil {
+			if deleteErr := deletePaste(paste.Id); deleteErr == ErrHeld {
+				Loggers.Warn.Printf("Paste %s is under legal hold, not deleted", paste.Id)
+				if strings.Contains(r.Header.Get("Accept"), "application/json") {
+					renderAjaxError(w, http.StatusLocked, http.StatusLocked, "Paste is under legal hold")
+					return
+				}
+				// Scripted clients get the status along with the page
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(http.StatusLocked)
+				if renderErr := renderTemplate(w, "paste.html", TemplateData{Code: http.StatusLocked}); renderErr != nil {
+					Loggers.Error.Printf("Cannot render template for paste %s: %s", paste.Id, renderErr)
+				}
+				return
+			} else if deleteErr == ErrNotFound {
+				// Deleted in the meantime
+				renderError(w, 404, "Not found")
+				return
+			} else if deleteErr != nil {
 				Loggers.Error.Printf("Cannot delete paste %s: %s", paste.Id, deleteErr)
 				renderError(w, 500, "Delete error")
 				return
 			}
 
-			if renderErr := render(w, TemplateData{Deleted: true}); renderErr != nil {
+			// The owner may restore a paste moved to the trash
+			data := TemplateData{Deleted: true}
+			if hasTrash() {
+				data.Undelete = "undelete/" + paste.Id + "/" + token
+			}
+			if renderErr := render(w, data); renderErr != nil {
 				Loggers.Error.Printf("Cannot render template for paste %s: %s", paste.Id, renderErr)
 				renderError(w, 500, "Render error")
 				return
@@ -289,39 +943,16 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 		}
 	case "POST":
 		// Client wants to post a paste or a comment
-
-		// Content-Type must be application/json
-		contentType := r.Header.Get("Content-Type")
-		matchJson, contentTypeErr := regexp.MatchString("application/json.*", contentType)
-		// TODO support charset
-
-		if contentTypeErr != nil {
-			Loggers.Warn.Println("Cannot detect Content-Type", contentTypeErr)
-			renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "Cannot detect content-type")
-			return
-		}
-
-		if !matchJson {
-			Loggers.Warn.Println("Wrong Content-Type, expecting application/json, got", contentType)
-			renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "Wrong content-type")
-			return
-		}
-
-		// Parse body
-		decoder := json.NewDecoder(r.Body)
-		var data Postdata
-		decodeErr := decoder.Decode(&data)
-		if decodeErr != nil {
-			Loggers.Error.Printf("Cannot parse json data: %s", decodeErr)
-			renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, "Cannot parse request body")
+		data, ok := readPostdata(w, r)
+		if !ok {
 			return
 		}
 
 		if data.Comment {
 			// This is a comment
 
-			// Check that paste exists
-			paste, err := loadPaste(data.Paste)
+			// Check that paste exists, its data is not needed
+			paste, _, err := store.GetMeta(data.Paste)
 			if err != nil {
 				Loggers.Error.Printf("Cannot load paste %s: %s", data.Paste, err)
 				renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Paste not found")
@@ -338,7 +969,7 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 			// Handle parent comment, if any
 			var parent *Comment = nil
 			if data.Parent != "" {
-				c, err := loadComment(data.Parent, &paste)
+				c, err := store.GetComment(&paste, data.Parent)
 				if err != nil {
 					Loggers.Error.Printf("Cannot load parent comment %s: %s", data.Parent, err)
 					renderAjaxError(w, http.StatusNotFound, http.StatusNotFound, "Parent not found")
@@ -359,7 +990,10 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 			comment.Author = data.Author
 			comment.computeAvatar(getIP(r))
 
-			if err := comment.save(&paste); err != nil {
+			if err := createComment(&paste, &comment); err == ErrQuota {
+				renderAjaxError(w, http.StatusInsufficientStorage, http.StatusInsufficientStorage, "Storage quota exceeded, please try again later")
+				return
+			} else if err != nil {
 				Loggers.Error.Printf("Unable to save comment %s: %s", comment.Id, err)
 				renderAjaxError(w, http.StatusInternalServerError, http.StatusInternalServerError, "Could not save comment")
 				return
@@ -394,16 +1028,36 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			// Check the paste lifetime against the expiration policy
+			if message := conf.checkLifetime(data.Expire); message != "" {
+				Loggers.Warn.Println(message)
+				renderAjaxError(w, http.StatusBadRequest, http.StatusBadRequest, message)
+				return
+			}
+
 			p := newPaste(data.Data)
-			p.Burn = data.Burn
+			p.MaxViews = data.MaxViews
+			if data.Burn {
+				p.MaxViews = 1
+			}
+			p.Burn = p.MaxViews == 1
 			p.Discussion = data.Discussion
 			p.Highlight = data.Highlight
-			p.Expire = p.Postdate.Add(time.Duration(data.Expire) * time.Second)
+			if data.Expire > 0 {
+				p.Expire = p.Postdate.Add(time.Duration(data.Expire) * time.Second)
+			}
+			p.ExpireAfterView = data.ExpireAfterView
+			for _, a := range data.Attachments {
+				p.Attachments = append(p.Attachments, newAttachment(a.Name, a.Data))
+			}
 
-			// TODO server's secret
-			Loggers.Info.Println("Delete token is ", p.hmac([]byte("secret")))
+			// Rules of the retention policy may shorten the paste lifetime
+			p.Expire = retainedUntil(&p, p.size())
 
-			if err := p.save(); err != nil {
+			if err := createPaste(&p); err == ErrQuota {
+				renderAjaxError(w, http.StatusInsufficientStorage, http.StatusInsufficientStorage, "Storage quota exceeded, please try again later")
+				return
+			} else if err != nil {
 				Loggers.Error.Printf("Unable to save paste %s: %s", p.Id, err)
 				renderAjaxError(w, http.StatusInternalServerError, http.StatusInternalServerError, "Could not save paste")
 				return
@@ -412,15 +1066,12 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 			// Update antiflood
 			updateFlood(getIP(r))
 
-			// Update index
-			p.index()
-
 			// Marshal response
 			j, err := json.Marshal(Postresponse{
 				Id:       p.Id,
 				Postdate: p.Postdate,
 				Expire:   p.Expire,
-				Delete:   p.hmac([]byte("secret")),
+				Delete:   deleteToken(&p),
 			})
 			if err != nil {
 				Loggers.Error.Printf("Marshal error: %s", err)
@@ -435,10 +1086,11 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func Serve(file string) {
+// Load the configuration file and initialize logging.
+func setup(file string) error {
 	// Load configuration
 	if err := conf.load(file); err != nil {
-		panic(err)
+		return err
 	}
 
 	// Initialize logging
@@ -460,30 +1112,85 @@ func Serve(file string) {
 	}
 	setVerbosity(conf.Verbosity)
 
+	return nil
+}
+
+// Serve runs the bingo web server with the given configuration file.
+func Serve(file string) {
+	if err := setup(file); err != nil {
+		panic(err)
+	}
+
 	// Initialize templates
 	initTemplates()
 
-	// Initialize data folder
-	if err := setupFolder(conf.Root, 0750); err != nil {
+	// Initialize URL patterns
+	initPatterns()
+
+	// Initialize store
+	s, err := openStore()
+	if err != nil {
 		panic(err)
 	}
+	store = s
 
-	// Build paste index
-	buildIndex()
+	// Load the secret key of delete tokens, in the data folder by default
+	if err := loadTokenKey(); err != nil {
+		panic(err)
+	}
 
-	// Start cleaner daemon
+	// Load paste index
+	if err := loadIndex(); err != nil {
+		panic(err)
+	}
+
+	// Start cleaner, snapshot and journal compaction daemons
 	startCleanDaemon()
+	startSnapshotDaemon()
+	startCompactDaemon()
 
 	// Serve static files
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(conf.Static))))
 
+	// Handle paste edits and revisions
+	http.HandleFunc("/edit/", handlerEdit)
+	http.HandleFunc("/undelete/", handlerUndelete)
+	http.HandleFunc("/revisions/", handlerRevisions)
+
+	// Handle attachments
+	http.HandleFunc("/attachment/", handlerAttachment)
+
+	// Handle paste metadata and burn paste reveals
+	http.HandleFunc("/meta/", handlerMeta)
+	http.HandleFunc("/reveal/", handlerReveal)
+
 	// Handle root
 	http.HandleFunc("/", handlerRoot)
 
 	addr := fmt.Sprintf(":%d", conf.Port)
 	Loggers.Info.Println("Listening on", addr)
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	server := &http.Server{Addr: addr}
+	go shutdownOnSignal(server)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		panic(err)
 	}
+
+	// Requests are over, every write is indexed
+	if hasSnapshot() {
+		if err := writeSnapshot(0); err != nil {
+			Loggers.Error.Printf("Cannot write index snapshot: %s", err)
+		}
+	}
+}
+
+// Stop the server on SIGINT or SIGTERM, once pending requests are over.
+func shutdownOnSignal(server *http.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	Loggers.Info.Printf("Received %s, shut down", sig)
+	if err := server.Shutdown(context.Background()); err != nil {
+		Loggers.Error.Printf("Cannot shut down: %s", err)
+	}
 }
@@ -0,0 +1,346 @@
+package bingo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Post json data to the root handler.
+func post(body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	handlerRoot(w, r)
+	return w
+}
+
+func TestPostSizeLimits(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+
+	conf.MaxPasteSize = 100
+	conf.MaxCommentSize = 50
+	conf.MaxAuthorSize = 10
+
+	requests := []struct {
+		body   string
+		status int
+	}{
+		// Field limits
+		{`{"data":"` + strings.Repeat("a", 101) + `"}`, http.StatusRequestEntityTooLarge},
+		{`{"comment":true,"data":"` + strings.Repeat("a", 51) + `"}`, http.StatusRequestEntityTooLarge},
+		{`{"comment":true,"data":"a","author":"` + strings.Repeat("a", 11) + `"}`, http.StatusRequestEntityTooLarge},
+		// Body limit, enforced while reading
+		{`{"data":"a","padding":"` + strings.Repeat("a", int(maxPostSize())) + `"}`, http.StatusRequestEntityTooLarge},
+		// Within limits
+		{`{"data":"` + strings.Repeat("a", 100) + `","expire":60}`, http.StatusOK},
+	}
+
+	for _, req := range requests {
+		antiflood.m = make(map[string]time.Time)
+		w := post(req.body)
+		if w.Code != req.status {
+			t.Errorf("POST %.40q status == %d, want %d", req.body, w.Code, req.status)
+		}
+		if w.Code == http.StatusRequestEntityTooLarge {
+			var e ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Code != w.Code || e.Error == "" {
+				t.Errorf("POST %.40q response == %q, want an error response", req.body, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestRevealBurnPaste(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	initPatterns()
+	conf.Views = "resources/views"
+	initTemplates()
+
+	antiflood.m = make(map[string]time.Time)
+	w := post(`{"data":"Secret","expire":60,"burn":true}`)
+	var created Postresponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("POST response == %q: %s", w.Body.String(), err)
+	}
+
+	// Link previews get the reveal page, without data
+	for i := 0; i < 2; i++ {
+		w := request(handlerRoot, "GET", "/"+created.Id, "")
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Secret") || !strings.Contains(w.Body.String(), `<textarea id="meta-reveal">`+created.Id) {
+			t.Errorf("GET /%s == %d %q, want the reveal page", created.Id, w.Code, w.Body.String())
+		}
+	}
+
+	w = request(handlerMeta, "GET", "/meta/"+created.Id, "")
+	var meta PasteMeta
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &meta) != nil || !meta.Burn || !meta.Expire.Equal(created.Expire) {
+		t.Errorf("GET /meta/%s == %d %q, want burn paste metadata", created.Id, w.Code, w.Body.String())
+	}
+	if w := request(handlerReveal, "GET", "/reveal/"+created.Id, ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /reveal/%s status == %d, want %d", created.Id, w.Code, http.StatusMethodNotAllowed)
+	}
+
+	// A single reveal gets the paste
+	w = request(handlerReveal, "POST", "/reveal/"+created.Id, "")
+	var paste Paste
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &paste) != nil || paste.Data != "Secret" {
+		t.Errorf("POST /reveal/%s == %d %q, want the paste", created.Id, w.Code, w.Body.String())
+	}
+	if w := request(handlerReveal, "POST", "/reveal/"+created.Id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("POST /reveal/%s twice status == %d, want %d", created.Id, w.Code, http.StatusNotFound)
+	}
+	if w := request(handlerMeta, "GET", "/meta/"+created.Id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /meta/%s after reveal status == %d, want %d", created.Id, w.Code, http.StatusNotFound)
+	}
+
+	// Other pastes are not revealed
+	antiflood.m = make(map[string]time.Time)
+	w = post(`{"data":"Public","expire":60}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if w := request(handlerReveal, "POST", "/reveal/"+created.Id, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /reveal/%s of a paste not burnt status == %d, want %d", created.Id, w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestViewLimit(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	initPatterns()
+
+	antiflood.m = make(map[string]time.Time)
+	if w := post(`{"data":"Secret","expire":60,"maxviews":-1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST with a negative view limit status == %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w := post(`{"data":"Secret","expire":60,"maxviews":2,"discussion":true}`)
+	var created Postresponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("POST response == %q: %s", w.Body.String(), err)
+	}
+	comment := newComment("Comment", nil)
+	if err := store.AppendComment(&Paste{Id: created.Id}, &comment); err != nil {
+		t.Fatal(err)
+	}
+
+	for remaining := 2; remaining > 0; remaining-- {
+		w := request(handlerMeta, "GET", "/meta/"+created.Id, "")
+		var meta PasteMeta
+		if json.Unmarshal(w.Body.Bytes(), &meta) != nil || meta.MaxViews != 2 || meta.Remaining != remaining || meta.Burn {
+			t.Errorf("GET /meta/%s == %q, want %d views left", created.Id, w.Body.String(), remaining)
+		}
+
+		w = request(handlerReveal, "POST", "/reveal/"+created.Id, "")
+		var paste Paste
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &paste) != nil || paste.Data != "Secret" || paste.remainingViews() != remaining-1 {
+			t.Errorf("POST /reveal/%s == %d %q, want the paste with %d views left", created.Id, w.Code, w.Body.String(), remaining-1)
+		}
+		if len(paste.Comments) != 1 || paste.Comments[0].Data != "Comment" {
+			t.Errorf("POST /reveal/%s comments == %+v, want the discussion", created.Id, paste.Comments)
+		}
+	}
+	if w := request(handlerReveal, "POST", "/reveal/"+created.Id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("POST /reveal/%s after the last view status == %d, want %d", created.Id, w.Code, http.StatusNotFound)
+	}
+}
+
+func TestExpireAfterView(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	initPatterns()
+	conf.Views = "resources/views"
+	initTemplates()
+
+	antiflood.m = make(map[string]time.Time)
+	w := post(`{"data":"Secret","expire":3600,"expireafterview":60}`)
+	var created Postresponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("POST response == %q: %s", w.Body.String(), err)
+	}
+	if next, _ := nextExpiration(); !next.Equal(created.Expire) {
+		t.Errorf("index expiration before the first view == %s, want %s", next, created.Expire)
+	}
+
+	var firstView time.Time
+	for i := 0; i < 2; i++ {
+		if w := request(handlerRoot, "GET", "/"+created.Id, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Secret") {
+			t.Fatalf("GET /%s == %d %q, want the paste", created.Id, w.Code, w.Body.String())
+		}
+		paste, err := store.GetPaste(created.Id)
+		if err != nil || paste.FirstView.IsZero() || (i > 0 && !paste.FirstView.Equal(firstView)) {
+			t.Errorf("paste after view #%d == %+v, %v, want the first view date", i, paste, err)
+		}
+		firstView = paste.FirstView
+	}
+
+	// The first view brings the expiration date forward
+	want := firstView.Add(time.Minute)
+	if next, _ := nextExpiration(); !next.Equal(want) {
+		t.Errorf("index expiration after the first view == %s, want %s", next, want)
+	}
+	w = request(handlerMeta, "GET", "/meta/"+created.Id, "")
+	var meta PasteMeta
+	if json.Unmarshal(w.Body.Bytes(), &meta) != nil || !meta.Expire.Equal(want) || meta.ExpireAfterView != 60 {
+		t.Errorf("GET /meta/%s == %q, want expiration %s", created.Id, w.Body.String(), want)
+	}
+}
+
+func TestExpirationPolicy(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	initPatterns()
+	conf.Views = "resources/views"
+	initTemplates()
+
+	conf.ExpireChoices = []int{60, 86400}
+	requests := []struct {
+		neverExpire bool
+		maxLifetime int
+		expire      int
+		status      int
+	}{
+		{false, 0, 60, http.StatusOK},
+		{false, 0, 61, http.StatusBadRequest},
+		{false, 0, -60, http.StatusBadRequest},
+		{false, 0, 0, http.StatusBadRequest},
+		{true, 0, 0, http.StatusOK},
+		{true, 3600, 0, http.StatusBadRequest},
+		{true, 3600, 86400, http.StatusBadRequest},
+	}
+	for _, req := range requests {
+		conf.NeverExpire, conf.MaxLifetime = req.neverExpire, req.maxLifetime
+		antiflood.m = make(map[string]time.Time)
+		w := post(`{"data":"Paste","expire":` + strconv.Itoa(req.expire) + `}`)
+		if w.Code != req.status {
+			t.Errorf("POST with expire %d (never %v, max %d) status == %d, want %d", req.expire, req.neverExpire, req.maxLifetime, w.Code, req.status)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var created Postresponse
+		json.Unmarshal(w.Body.Bytes(), &created)
+		paste, err := store.GetPaste(created.Id)
+		if err != nil || paste.hasExpired() || paste.Expire.IsZero() != (req.expire == 0) {
+			t.Errorf("paste posted with expire %d == %+v, %v", req.expire, paste, err)
+		}
+	}
+
+	// Pastes which never expire stay in the index
+	deleteExpiredPastes()
+	if len(index.h) != 2 {
+		t.Errorf("index holds %d pastes after cleaning, want 2", len(index.h))
+	}
+	if next, ok := nextExpiration(); !ok || next.IsZero() {
+		t.Errorf("nextExpiration() == %s, %v, want the paste which expires", next, ok)
+	}
+
+	// The form offers the allowed lifetimes
+	conf.NeverExpire, conf.MaxLifetime = true, 0
+	w := request(handlerRoot, "GET", "/", "")
+	for _, label := range []string{">1 minute<", ">1 day<", ">Never<"} {
+		if !strings.Contains(w.Body.String(), label) {
+			t.Errorf("GET / does not offer %s", label)
+		}
+	}
+	if strings.Contains(w.Body.String(), ">5 seconds<") {
+		t.Errorf("GET / offers a lifetime which is not allowed")
+	}
+}
+
+func TestLifetimeLabel(t *testing.T) {
+	labels := map[int]string{
+		0:        "Never",
+		5:        "5 seconds",
+		60:       "1 minute",
+		90:       "90 seconds",
+		7200:     "2 hours",
+		604800:   "1 week",
+		31536000: "1 year",
+	}
+	for seconds, want := range labels {
+		if got := lifetimeLabel(seconds); got != want {
+			t.Errorf("lifetimeLabel(%d) == %q, want %q", seconds, got, want)
+		}
+	}
+}
+
+func TestTrash(t *testing.T) {
+	defer func(c Conf) { conf = c }(conf)
+	setupTestStore()
+	initPatterns()
+	conf.Views = "resources/views"
+	initTemplates()
+	conf.TrashGrace = 3600
+
+	antiflood.m = make(map[string]time.Time)
+	var created Postresponse
+	if err := json.Unmarshal(post(`{"data":"Paste","expire":3600}`).Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	undelete := "/undelete/" + created.Id + "/" + created.Delete
+
+	// Deleted pastes are moved to the trash
+	w := request(handlerRoot, "GET", "/delete/"+created.Id+"/"+created.Delete, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<textarea id="meta-undelete">`+undelete[1:]) {
+		t.Errorf("GET /delete/%s == %d %q, want an undelete link", created.Id, w.Code, w.Body.String())
+	}
+	if w := request(handlerMeta, "GET", "/meta/"+created.Id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /meta/%s of a deleted paste status == %d, want %d", created.Id, w.Code, http.StatusNotFound)
+	}
+	if e, ok := index.ids[created.Id]; !ok || !e.trashed {
+		t.Errorf("deleted paste index entry == %+v, want an entry in the trash", e)
+	}
+
+	// Only its owner restores it
+	if w := request(handlerUndelete, "GET", undelete, ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET %s status == %d, want %d", undelete, w.Code, http.StatusMethodNotAllowed)
+	}
+	wrong := "/undelete/" + created.Id + "/" + strings.Repeat("0", 20)
+	if w := request(handlerUndelete, "POST", wrong, ""); w.Code != http.StatusForbidden {
+		t.Errorf("POST %s status == %d, want %d", wrong, w.Code, http.StatusForbidden)
+	}
+	if w := request(handlerUndelete, "POST", undelete, ""); w.Code != http.StatusOK {
+		t.Errorf("POST %s == %d %q, want the restored paste", undelete, w.Code, w.Body.String())
+	}
+	if w := request(handlerMeta, "GET", "/meta/"+created.Id, ""); w.Code != http.StatusOK {
+		t.Errorf("GET /meta/%s of a restored paste status == %d, want %d", created.Id, w.Code, http.StatusOK)
+	}
+	if w := request(handlerUndelete, "POST", undelete, ""); w.Code != http.StatusNotFound {
+		t.Errorf("POST %s twice status == %d, want %d", undelete, w.Code, http.StatusNotFound)
+	}
+
+	// Expired pastes are moved to the trash, and purged at the end of the grace period
+	expired := newPaste("Expired paste")
+	expired.Expire = time.Now().Add(-time.Minute)
+	if err := createPaste(&expired); err != nil {
+		t.Fatal(err)
+	}
+	deleteExpiredPastes()
+	if _, err := store.GetTrash(expired.Id); err != nil {
+		t.Errorf("GetTrash(%q) of an expired paste error: %s", expired.Id, err)
+	}
+	indexTrash(expired.Id, true, time.Now().Add(-time.Minute))
+	deleteExpiredPastes()
+	if _, err := store.GetTrash(expired.Id); err != ErrNotFound {
+		t.Errorf("GetTrash(%q) after the grace period error == %v, want %v", expired.Id, err, ErrNotFound)
+	}
+
+	// Burned pastes are not kept
+	antiflood.m = make(map[string]time.Time)
+	if err := json.Unmarshal(post(`{"data":"Secret","expire":3600,"burn":true}`).Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	request(handlerReveal, "POST", "/reveal/"+created.Id, "")
+	if _, err := store.GetTrash(created.Id); err != ErrNotFound {
+		t.Errorf("GetTrash(%q) of a burned paste error == %v, want %v", created.Id, err, ErrNotFound)
+	}
+}
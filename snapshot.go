@@ -0,0 +1,291 @@
+package bingo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Name of the index snapshot file, in the snapshot folder.
+const snapshotFile = "index.snapshot"
+
+// Name of the snapshot folder, in the data folder. Writing the snapshot in
+// its own folder leaves the modification date of the data folder alone.
+const snapshotFolder = "snapshot+index"
+
+// Version of the index snapshot format.
+const snapshotVersion = 1
+
+// Writes to the store are indexed a bit later, so the date of snapshots taken
+// while serving is set back by this margin: a write not indexed yet when the
+// snapshot is taken makes it stale.
+const snapshotMargin = 10 * time.Second
+
+// errStaleSnapshot is returned when the store was written after the index snapshot.
+var errStaleSnapshot = errors.New("index snapshot is stale")
+
+/*
+Index snapshot.
+
+ - Version: snapshot format, see snapshotVersion
+ - Date: the store was not written after this date when the snapshot was taken
+ - Storage: storage of the indexed pastes
+ - Depth: folder depth of the indexed pastes
+ - Retention: checksum of the retention policy the entries expire by, see retentionChecksum
+ - Entries: index entries
+ - Checksum: sha256 of the snapshot, without checksum
+*/
+type indexSnapshot struct {
+	Version   int             `json:"version"`
+	Date      time.Time       `json:"date"`
+	Storage   string          `json:"storage"`
+	Depth     int             `json:"depth"`
+	Retention string          `json:"retention,omitempty"`
+	Entries   []snapshotEntry `json:"entries"`
+	Checksum  string          `json:"checksum,omitempty"`
+}
+
+/*
+Index entry in a snapshot.
+
+ - Id: paste id
+ - Expire: paste expiration date
+ - Size: size of the paste, its comments, revisions and attachments
+ - Trashed: whether the paste is in the trash, Expire being the end of its grace period
+*/
+type snapshotEntry struct {
+	Id      string    `json:"id"`
+	Expire  time.Time `json:"expire"`
+	Size    int64     `json:"size"`
+	Trashed bool      `json:"trashed,omitempty"`
+}
+
+// Whether the storage keeps its data in the data folder, which can hold a snapshot.
+func hasSnapshot() bool {
+	return conf.Storage == "files" || conf.Storage == "journal"
+}
+
+// Path of the index snapshot.
+func snapshotPath() string {
+	return filepath.Join(conf.Root, snapshotFolder, snapshotFile)
+}
+
+// Create the snapshot folder, removing the snapshot of older versions
+// written in the data folder itself.
+func setupSnapshotFolder() error {
+	if err := os.Remove(filepath.Join(conf.Root, snapshotFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return setupFolder(filepath.Join(conf.Root, snapshotFolder), 0750)
+}
+
+// Compute the checksum of a snapshot.
+func (snapshot indexSnapshot) checksum() (string, error) {
+	snapshot.Checksum = ""
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Sealer of the store records, sealing the snapshot as well: the snapshot
+// lists every paste id.
+func snapshotSealer() *sealer {
+	if s, ok := store.(*recordStore); ok {
+		return s.sealer
+	}
+	return nil
+}
+
+// Write a snapshot of the index to the data folder, encrypted like the store
+// records. The snapshot date is set back by margin, for writes which may not be
+// indexed yet.
+func writeSnapshot(margin time.Duration) error {
+	// Creating the folder modifies the data folder, before the snapshot date
+	if err := setupSnapshotFolder(); err != nil {
+		return err
+	}
+	date := time.Now().Add(-margin)
+	index.RLock()
+	entries := make([]snapshotEntry, len(index.h))
+	for i, e := range index.h {
+		entries[i] = snapshotEntry{e.id, e.expire, e.size, e.trashed}
+	}
+	index.RUnlock()
+
+	snapshot := indexSnapshot{
+		Version:   snapshotVersion,
+		Date:      date,
+		Storage:   conf.Storage,
+		Depth:     conf.Depth,
+		Retention: retentionChecksum(),
+		Entries:   entries,
+	}
+	sum, err := snapshot.checksum()
+	if err != nil {
+		return err
+	}
+	snapshot.Checksum = sum
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	data, err = snapshotSealer().seal(snapshotFolder, data)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(snapshotPath(), data, 0640, false); err != nil {
+		return err
+	}
+	Loggers.Info.Printf("Index snapshot written with %d entries", len(entries))
+	return nil
+}
+
+// Read the index snapshot.
+// Fails when the snapshot is corrupt, does not match the configuration, or
+// the store was written after the snapshot was taken.
+func readSnapshot() ([]indexEntry, error) {
+	data, err := ioutil.ReadFile(snapshotPath())
+	if err != nil {
+		return nil, err
+	}
+	data, err = snapshotSealer().open(snapshotFolder, data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt index snapshot: %s", err)
+	}
+	var snapshot indexSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("corrupt index snapshot: %s", err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("unknown index snapshot version %d", snapshot.Version)
+	}
+	if sum, err := snapshot.checksum(); err != nil || sum != snapshot.Checksum {
+		return nil, errors.New("corrupt index snapshot: checksum mismatch")
+	}
+	if snapshot.Storage != conf.Storage || snapshot.Depth != conf.Depth {
+		return nil, errors.New("index snapshot of another storage")
+	}
+	if snapshot.Retention != retentionChecksum() {
+		// Built again, applying the new policy to stored pastes
+		return nil, errors.New("index snapshot of another retention policy")
+	}
+	if err := checkSnapshotDate(snapshot.Date); err != nil {
+		return nil, err
+	}
+
+	entries := make([]indexEntry, len(snapshot.Entries))
+	for i, e := range snapshot.Entries {
+		entries[i] = indexEntry{id: e.Id, expire: e.Expire, size: e.Size, trashed: e.Trashed}
+	}
+	return entries, nil
+}
+
+// Check that the store was not written after a date.
+// Only modification dates are read: any folder modified after the date (eg.
+// the folder of a new paste, or a folder a paste was deleted from) makes the
+// snapshot stale.
+func checkSnapshotDate(date time.Time) error {
+	if conf.Storage == "journal" {
+		stat, err := os.Stat(conf.Journal)
+		if err != nil {
+			return err
+		}
+		if stat.ModTime().After(date) {
+			return errStaleSnapshot
+		}
+		return nil
+	}
+
+	return checkFolderDate(conf.Root, date)
+}
+
+// Check that a folder and its subfolders were not modified after a date.
+// Files are not checked: they are written to a temporary file renamed into
+// their folder, so writing, adding or removing a file modifies its folder.
+func checkFolderDate(folder string, date time.Time) error {
+	info, err := os.Stat(folder)
+	if os.IsNotExist(err) {
+		// Removed in the meantime
+		return errStaleSnapshot
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().After(date) {
+		return errStaleSnapshot
+	}
+
+	entries, err := os.ReadDir(folder)
+	if os.IsNotExist(err) {
+		return errStaleSnapshot
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || strings.HasPrefix(name, tempPrefix) || (folder == conf.Root && (name == lostFound || name == snapshotFolder)) {
+			continue
+		}
+		if err := checkFolderDate(filepath.Join(folder, name), date); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load the paste index from its snapshot, or build it from the store when
+// the snapshot is missing, stale or corrupt.
+func loadIndex() error {
+	if hasSnapshot() {
+		entries, err := readSnapshot()
+		if err == nil {
+			index.Lock()
+			resetIndex(entries)
+			index.Unlock()
+			Loggers.Info.Printf("Paste index loaded from snapshot with %d entries", len(entries))
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			Loggers.Warn.Printf("Cannot use index snapshot: %s", err)
+		}
+	}
+
+	if err := buildIndex(); err != nil {
+		return err
+	}
+	if hasSnapshot() {
+		if err := writeSnapshot(0); err != nil {
+			Loggers.Error.Printf("Cannot write index snapshot: %s", err)
+		}
+	}
+	return nil
+}
+
+// Start the snapshot daemon, writing an index snapshot once in
+// SnapshotInterval seconds.
+func startSnapshotDaemon() {
+	if !hasSnapshot() || conf.SnapshotInterval <= 0 {
+		return
+	}
+	Loggers.Info.Printf("Start snapshot daemon with a %d seconds interval", conf.SnapshotInterval)
+	tick := time.NewTicker(time.Duration(conf.SnapshotInterval) * time.Second).C
+	go func() {
+		for _ = range tick {
+			if err := writeSnapshot(snapshotMargin); err != nil {
+				Loggers.Error.Printf("Cannot write index snapshot: %s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,140 @@
+package bingo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	defer func(c Conf, s Store) { conf, store = c, s }(conf, store)
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+
+	conf.Root, conf.Storage, conf.Depth = root, "files", 2
+	store = newFileStore(root, 2)
+	resetTestIndex := func() {
+		index.Lock()
+		resetIndex(nil)
+		index.Unlock()
+	}
+	resetTestIndex()
+
+	pastes := make([]Paste, 3)
+	for i := range pastes {
+		pastes[i] = newPaste("Awesome paste")
+		pastes[i].Expire = time.Now().Add(time.Hour)
+		if err := createPaste(&pastes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := index.size
+
+	// Written after a full scan
+	resetTestIndex()
+	if err := loadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readSnapshot()
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("readSnapshot() == %v, %v, want 3 entries", entries, err)
+	}
+
+	// Loaded from the snapshot
+	resetTestIndex()
+	if err := loadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.h) != 3 || index.size != size {
+		t.Errorf("index loaded from snapshot holds %d pastes of %d bytes, want 3 pastes of %d bytes", len(index.h), index.size, size)
+	}
+
+	// Stale once a paste is deleted
+	time.Sleep(10 * time.Millisecond)
+	if err := deletePaste(pastes[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSnapshot(); err != errStaleSnapshot {
+		t.Errorf("readSnapshot() after delete error == %v, want %v", err, errStaleSnapshot)
+	}
+	resetTestIndex()
+	if err := loadIndex(); err != nil || len(index.h) != 2 {
+		t.Errorf("index built after a stale snapshot holds %d pastes, %v, want 2", len(index.h), err)
+	}
+
+	// Corrupt snapshots are not loaded
+	data, err := ioutil.ReadFile(snapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	if err := ioutil.WriteFile(snapshotPath(), data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSnapshot(); err == nil {
+		t.Errorf("readSnapshot() of a corrupt snapshot succeeded")
+	}
+
+	// Nor snapshots of another layout
+	if err := writeSnapshot(0); err != nil {
+		t.Fatal(err)
+	}
+	conf.Depth = 3
+	if _, err := readSnapshot(); err == nil {
+		t.Errorf("readSnapshot() at another depth succeeded")
+	}
+
+	// Pastes deleted from the data folder itself make the snapshot stale
+	conf.Depth = 0
+	store = newFileStore(root, 0)
+	paste := newPaste("Awesome paste")
+	if err := createPaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSnapshot(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSnapshot(); err != nil {
+		t.Errorf("readSnapshot() at depth 0 error: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := deletePaste(paste.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSnapshot(); err != errStaleSnapshot {
+		t.Errorf("readSnapshot() after delete at depth 0 error == %v, want %v", err, errStaleSnapshot)
+	}
+
+	// Snapshots are encrypted like the store records
+	sealed := newFileStore(root, 0)
+	sealed.sealer, _ = newSealer(testKey1, nil)
+	store = sealed
+	paste = newPaste("Awesome paste")
+	if err := createPaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSnapshot(0); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(snapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(paste.Id)) {
+		t.Errorf("snapshot written with an encryption key holds paste id %s in clear", paste.Id)
+	}
+	entries, err = readSnapshot()
+	found := false
+	for _, e := range entries {
+		found = found || e.id == paste.Id
+	}
+	if err != nil || !found {
+		t.Errorf("readSnapshot() of an encrypted snapshot == %v, %v, want paste %s", entries, err, paste.Id)
+	}
+	sealed.sealer = nil
+	if _, err := readSnapshot(); err == nil {
+		t.Errorf("readSnapshot() of an encrypted snapshot without key succeeded")
+	}
+}
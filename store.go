@@ -0,0 +1,1044 @@
+package bingo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store errors.
+var (
+	// ErrNotFound is returned when a paste or a comment does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned when creating a paste or a comment whose id is already in use.
+	ErrExists = errors.New("already exists")
+	// ErrHeld is returned when deleting a paste under legal hold.
+	ErrHeld = errors.New("paste is under legal hold")
+)
+
+// A configError tells that a record cannot be read with the current
+// configuration (eg. it is encrypted with a key which is not configured),
+// rather than that the record is corrupt.
+type configError struct {
+	msg string
+}
+
+func (e *configError) Error() string {
+	return e.msg
+}
+
+// Whether err tells that a record cannot be read with the current configuration.
+func isConfigError(err error) bool {
+	_, ok := err.(*configError)
+	return ok
+}
+
+/*
+A Store persists pastes and their comments.
+
+Handlers and the clean daemon only talk to the global store instance so that
+storage backends can be swapped without touching the HTTP code.
+
+ - CreatePaste: save a new paste, fails with ErrExists if its id is in use
+ - PutPaste: save a paste, replacing any previous version but its views, its trash date and its legal hold, fails with ErrNotFound if it was deleted
+ - GetPaste: load a paste, fails with ErrNotFound if it is in the trash
+ - GetMeta: load a paste without its data, along with the size of its data, fails with ErrNotFound if it is in the trash
+ - DeletePaste: delete a paste, its discussion, its revisions and its attachments, fails with ErrHeld if it is under legal hold
+ - TrashPaste: move a paste to the trash, fails with ErrNotFound if it is already in the trash and with ErrHeld if it is under legal hold
+ - GetTrash: load a paste in the trash, fails with ErrNotFound if it is not in the trash
+ - RestorePaste: move a paste out of the trash, fails with ErrNotFound if it is not in the trash
+ - PurgePaste: delete a paste in the trash, fails with ErrNotFound if it is not in the trash and with ErrHeld if it is under legal hold
+ - SetHold: place or release (nil hold) the legal hold of a paste, in the trash or not, returns its previous hold; a paste whose views were used up under the hold is deleted on release
+ - ViewPaste: load a paste and count a view: the first view date is saved, and a paste with a view limit is loaded with its attachments and comments and deleted on its last view, unless it is under legal hold
+ - AppendComment: save a new comment in a paste discussion, fails with ErrExists if its id is in use
+ - GetComment: load a comment of a paste discussion
+ - ListComments: load all comments of a paste discussion, sorted by date
+ - AddRevision: save a previous revision of a paste, fails with ErrExists if it already exists and with ErrNotFound if the paste was deleted
+ - GetRevision: load a previous revision of a paste
+ - ListRevisions: load all previous revisions of a paste, sorted by number
+ - PutAttachment: save the data of an attachment of a paste, fails with ErrExists if it already exists
+ - GetAttachment: load an attachment of a paste, along with its data
+ - Walk: call fn for every stored paste, including pastes in the trash
+ - WalkMeta: call fn for every stored paste, including pastes in the trash, loaded without its data, along with the size of its data
+*/
+type Store interface {
+	CreatePaste(paste *Paste) error
+	PutPaste(paste *Paste) error
+	GetPaste(id string) (Paste, error)
+	GetMeta(id string) (Paste, int64, error)
+	DeletePaste(id string) error
+	TrashPaste(id string) (Paste, error)
+	GetTrash(id string) (Paste, error)
+	RestorePaste(id string) (Paste, error)
+	PurgePaste(id string) error
+	SetHold(id string, hold *Hold) (*Hold, error)
+	ViewPaste(id string) (Paste, error)
+	AppendComment(paste *Paste, comment *Comment) error
+	GetComment(paste *Paste, id string) (Comment, error)
+	ListComments(paste *Paste) ([]Comment, error)
+	AddRevision(paste *Paste, rev *Revision) error
+	GetRevision(paste *Paste, n int) (Revision, error)
+	ListRevisions(paste *Paste) ([]Revision, error)
+	PutAttachment(paste *Paste, attachment *Attachment) error
+	GetAttachment(paste *Paste, id string) (Attachment, error)
+	Walk(fn func(paste *Paste) error) error
+	WalkMeta(fn func(paste *Paste, size int64) error) error
+}
+
+// Global store instance.
+var store Store
+
+// Open the store described by the configuration.
+func openStore() (Store, error) {
+	if err := setupFolder(conf.Root, 0750); err != nil {
+		return nil, err
+	}
+
+	c, err := findCodec(conf.Compression)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newSealer(conf.EncryptionKey, conf.OldEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	switch conf.Storage {
+	case "files":
+		return &recordStore{b: &fileBackend{root: conf.Root, depth: conf.Depth}, codec: c, sealer: sealer}, nil
+	case "journal":
+		if err := setupFolder(filepath.Dir(conf.Journal), 0750); err != nil {
+			return nil, err
+		}
+		b, err := openJournal(conf.Journal)
+		if err != nil {
+			return nil, err
+		}
+		return &recordStore{b: b, codec: c, sealer: sealer}, nil
+	case "s3":
+		b := newS3Backend(conf.S3Endpoint, conf.S3Bucket, conf.S3Prefix, conf.S3Region, conf.S3AccessKey, conf.S3SecretKey)
+		return &recordStore{b: b, codec: c, sealer: sealer}, nil
+	}
+
+	return nil, fmt.Errorf("unknown storage %q", conf.Storage)
+}
+
+/*
+A backend stores raw records by key.
+
+Paste metadata records are stored under their id, and paste data under
+"<id>.bin". Records related to a paste are stored below a name derived from
+the paste id (eg. comments are stored below "<id>_", revisions below "<id>~"
+and attachments below "<id>-"), so that removing this name removes all of
+them at once.
+
+ - get: read a record
+ - create: write a new record, fails with ErrExists if the key is in use
+ - put: write a record, replacing any previous one
+ - remove: delete a record, or everything stored below a name
+ - list: names of the records stored below a name
+ - walk: call fn with the key of every top-level record
+ - quarantine: move an unreadable record out of the way
+*/
+type backend interface {
+	get(key string) ([]byte, error)
+	create(key string, data []byte) error
+	put(key string, data []byte) error
+	remove(key string) error
+	list(name string) ([]string, error)
+	walk(fn func(key string) error) error
+	quarantine(key string) error
+}
+
+/*
+A Store serializing pastes and comments as json records in a backend.
+
+ - b: records backend
+ - codec: compression codec of written records, nil to write plain json
+ - sealer: encryption of written records, nil to write them in clear
+ - locks: per-paste locks, serializing views and saves of a paste
+*/
+type recordStore struct {
+	b      backend
+	codec  *codec
+	sealer *sealer
+	locks  pasteLocks
+}
+
+// Number of per-paste locks of a store, pastes sharing locks by id hash.
+const pasteLockCount = 64
+
+// Per-paste locks.
+type pasteLocks [pasteLockCount]sync.Mutex
+
+// Lock of a paste.
+func (l *pasteLocks) get(id string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &l[h.Sum32()%pasteLockCount]
+}
+
+// Create a new store on top of a file backend.
+func newFileStore(root string, depth int) *recordStore {
+	return &recordStore{b: &fileBackend{root: root, depth: depth}}
+}
+
+// Create a new in-memory store.
+func newMemoryStore() *recordStore {
+	return &recordStore{b: newMemoryBackend()}
+}
+
+// Key of the discussion of a paste.
+func discussionKey(id string) string {
+	return id + "_"
+}
+
+// Key of a comment.
+func commentKey(pasteId, id string) string {
+	return discussionKey(pasteId) + "/" + id
+}
+
+// Key of the revisions of a paste.
+func revisionsKey(id string) string {
+	return id + "~"
+}
+
+// Key of a revision.
+func revisionKey(pasteId string, n int) string {
+	return revisionsKey(pasteId) + "/" + strconv.Itoa(n)
+}
+
+// Marshal, compress and seal the record stored under key.
+func (s *recordStore) encode(key string, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return s.pack(key, data)
+}
+
+// Open, decompress and unmarshal the record stored under key.
+// Legacy uncompressed and clear records are read as well.
+func (s *recordStore) decode(key string, data []byte, v interface{}) error {
+	data, err := s.unpack(key, data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Compress and seal the raw data of the record stored under key.
+func (s *recordStore) pack(key string, data []byte) ([]byte, error) {
+	data, err := compress(s.codec, data)
+	if err != nil {
+		return nil, err
+	}
+	return s.sealer.seal(key, data)
+}
+
+// Open and decompress the raw data of the record stored under key.
+func (s *recordStore) unpack(key string, data []byte) ([]byte, error) {
+	data, err := s.sealer.open(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data)
+}
+
+// Open and decompress the blob of a paste.
+// Blobs are raw data, so their codec is given by the metadata record rather
+// than guessed from the blob.
+func (s *recordStore) unpackBlob(rec *pasteRecord, blob []byte) ([]byte, error) {
+	blob, err := s.sealer.open(blobKey(rec.Paste.Id), blob)
+	if err != nil {
+		return nil, err
+	}
+	return decompressWith(rec.Compression, blob)
+}
+
+// Keys of all the records of a paste.
+func (s *recordStore) recordKeys(id string) ([]string, error) {
+	comments, err := s.b.list(discussionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	revisions, err := s.b.list(revisionsKey(id))
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := s.b.list(attachmentsKey(id))
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{id, blobKey(id)}
+	for _, c := range comments {
+		keys = append(keys, commentKey(id, c))
+	}
+	for _, a := range attachments {
+		keys = append(keys, attachmentKey(id, a))
+	}
+	for _, r := range revisions {
+		keys = append(keys, revisionsKey(id)+"/"+r)
+	}
+	return keys, nil
+}
+
+// Rewrite every record with the current compression and encryption key.
+// Returns the number of rewritten records.
+func (s *recordStore) rewrite() (int, error) {
+	n := 0
+	err := s.b.walk(func(id string) error {
+		if !regexName.MatchString(id) {
+			// Not a paste, rewritten along with its paste
+			return nil
+		}
+		keys, err := s.recordKeys(id)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key == blobKey(id) {
+				// Rewritten along with the metadata record
+				continue
+			}
+			rewrite := s.rewriteRecord
+			if key == id {
+				rewrite = s.rewritePaste
+			}
+			count, err := rewrite(key)
+			if err != nil {
+				return err
+			}
+			n += count
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Rewrite a record with the current compression and encryption key.
+// Returns the number of rewritten records.
+func (s *recordStore) rewriteRecord(key string) (int, error) {
+	data, err := s.b.get(key)
+	if err == ErrNotFound {
+		// Deleted in the meantime
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot read %s: %s", key, err)
+	}
+	data, err = s.unpack(key, data)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read %s: %s", key, err)
+	}
+	data, err = s.pack(key, data)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.b.put(key, data); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// Rewrite the metadata record and the blob of a paste with the current
+// compression and encryption key, the metadata record giving the codec of
+// the blob. Returns the number of rewritten records.
+func (s *recordStore) rewritePaste(id string) (int, error) {
+	rec, err := s.getRecord(id)
+	if err == ErrNotFound {
+		// Deleted in the meantime
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot read %s: %s", id, err)
+	}
+	if rec.Schema < pasteSchema {
+		// Legacy record, without blob
+		return s.rewriteRecord(id)
+	}
+
+	blob, err := s.b.get(blobKey(id))
+	if err == nil {
+		blob, err = s.unpackBlob(&rec, blob)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot read %s: %s", blobKey(id), err)
+	}
+	blob, err = s.pack(blobKey(id), blob)
+	if err != nil {
+		return 0, err
+	}
+	rec.Compression = codecName(s.codec)
+	meta, err := s.encode(id, rec)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.b.put(blobKey(id), blob); err != nil {
+		return 0, err
+	}
+	if err := s.b.put(id, meta); err != nil {
+		return 0, err
+	}
+	return 2, nil
+}
+
+// Marshal a paste into a metadata record and a blob.
+func (s *recordStore) encodePaste(paste *Paste) ([]byte, []byte, error) {
+	rec, blob := newPasteRecord(paste)
+	rec.Compression = codecName(s.codec)
+	meta, err := s.encode(paste.Id, rec)
+	if err != nil {
+		return nil, nil, err
+	}
+	blob, err = s.pack(blobKey(paste.Id), blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, blob, nil
+}
+
+// Save a new paste.
+// The blob is written first, so that a paste can never be read without its
+// data, and fails with ErrExists if the id is in use.
+func (s *recordStore) CreatePaste(paste *Paste) error {
+	Loggers.Info.Printf("Create paste %s", paste.Id)
+
+	// Marshal paste
+	meta, blob, err := s.encodePaste(paste)
+	if err != nil {
+		return err
+	}
+
+	if err := s.b.create(blobKey(paste.Id), blob); err != nil {
+		return err
+	}
+	if err := s.b.create(paste.Id, meta); err != nil {
+		if err == ErrExists {
+			// Legacy paste, stored without blob
+			s.b.remove(blobKey(paste.Id))
+		}
+		return err
+	}
+	return nil
+}
+
+// Save a paste.
+// Views are counted by ViewPaste, so the stored view count and first view
+// date are kept, and so are the trash date of a paste deleted meanwhile and
+// legal holds, which are only set by SetHold.
+func (s *recordStore) PutPaste(paste *Paste) error {
+	l := s.locks.get(paste.Id)
+	l.Lock()
+	defer l.Unlock()
+
+	// Deleted pastes are not created again
+	rec, err := s.getRecord(paste.Id)
+	if err != nil {
+		return err
+	}
+	paste.Views, paste.FirstView = rec.Paste.Views, rec.Paste.FirstView
+	paste.Trashed, paste.Hold = rec.Paste.Trashed, rec.Paste.Hold
+	return s.putPaste(paste)
+}
+
+// Save a paste, keeping its stored legal hold, caller must hold its lock.
+// The hold is read again right before the write: holds are changed by the
+// hold command, which runs in another process than the server.
+func (s *recordStore) putPaste(paste *Paste) error {
+	unlock, err := s.lockHolds(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if rec, err := s.getRecord(paste.Id); err == nil {
+		paste.Hold = rec.Paste.Hold
+	} else if err != ErrNotFound {
+		return err
+	}
+	return s.writePaste(paste)
+}
+
+// Save the metadata of a paste whose data did not change (eg. its view
+// count), keeping its stored legal hold, caller must hold its lock.
+// The blob of the paste is not written again.
+func (s *recordStore) putMeta(paste *Paste) error {
+	unlock, err := s.lockHolds(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rec, err := s.getRecord(paste.Id)
+	if err != nil {
+		return err
+	}
+	paste.Hold = rec.Paste.Hold
+	return s.writeMeta(rec, paste)
+}
+
+// Save the metadata record of a paste as is, along with the size and encoding
+// of its stored data, caller must hold its lock.
+func (s *recordStore) writeMeta(rec pasteRecord, paste *Paste) error {
+	Loggers.Info.Printf("Save paste metadata %s", paste.Id)
+
+	rec.Paste = pasteMeta(paste)
+	meta, err := s.encode(paste.Id, rec)
+	if err != nil {
+		return err
+	}
+	return s.b.put(paste.Id, meta)
+}
+
+// Save a paste as is, caller must hold its lock.
+func (s *recordStore) writePaste(paste *Paste) error {
+	Loggers.Info.Printf("Save paste %s", paste.Id)
+
+	// Marshal paste
+	meta, blob, err := s.encodePaste(paste)
+	if err != nil {
+		return err
+	}
+
+	if err := s.b.put(blobKey(paste.Id), blob); err != nil {
+		return err
+	}
+	return s.b.put(paste.Id, meta)
+}
+
+// Load the metadata record of a paste.
+// Legacy records hold the paste data as well.
+func (s *recordStore) getRecord(id string) (pasteRecord, error) {
+	data, err := s.b.get(id)
+	if err != nil {
+		Loggers.Error.Printf("Paste read error %s: %s", id, err)
+		return pasteRecord{}, err
+	}
+
+	rec, err := s.decodeRecord(id, data)
+	if err != nil {
+		Loggers.Error.Printf("Paste unmarshal error %s: %s", id, err)
+		return pasteRecord{}, err
+	}
+	return rec, nil
+}
+
+// Decode the metadata record of a paste.
+func (s *recordStore) decodeRecord(id string, data []byte) (pasteRecord, error) {
+	rec := pasteRecord{Paste: &Paste{Id: id}}
+	if err := s.decode(id, data, &rec); err != nil {
+		return pasteRecord{}, err
+	}
+	if rec.Schema > pasteSchema {
+		return pasteRecord{}, &configError{fmt.Sprintf("unsupported paste schema %d", rec.Schema)}
+	}
+	if rec.Schema < pasteSchema {
+		// Legacy record
+		rec.Size = int64(len(rec.Data))
+	}
+	return rec, nil
+}
+
+// Load the metadata record of a paste in the trash if trashed is set, out
+// of the trash otherwise. Fails with ErrNotFound for other pastes.
+func (s *recordStore) findRecord(id string, trashed bool) (pasteRecord, error) {
+	rec, err := s.getRecord(id)
+	if err != nil {
+		return pasteRecord{}, err
+	}
+	if rec.Paste.Trashed.IsZero() == trashed {
+		return pasteRecord{}, ErrNotFound
+	}
+	return rec, nil
+}
+
+// Load a paste.
+func (s *recordStore) GetPaste(id string) (Paste, error) {
+	Loggers.Info.Printf("Load paste %s", id)
+	return s.loadPaste(id, false)
+}
+
+// Load a paste in the trash.
+func (s *recordStore) GetTrash(id string) (Paste, error) {
+	Loggers.Info.Printf("Load paste %s from the trash", id)
+	return s.loadPaste(id, true)
+}
+
+// Load a paste in the trash if trashed is set, out of the trash otherwise.
+func (s *recordStore) loadPaste(id string, trashed bool) (Paste, error) {
+	rec, err := s.findRecord(id, trashed)
+	if err != nil {
+		return Paste{}, err
+	}
+	if err := s.loadBlob(&rec); err != nil {
+		return Paste{}, err
+	}
+	return *rec.Paste, nil
+}
+
+// Load the data of a paste from its blob.
+func (s *recordStore) loadBlob(rec *pasteRecord) error {
+	if rec.Schema < pasteSchema {
+		// Legacy record, holding the data
+		rec.Paste.Data = rec.Data
+		return nil
+	}
+
+	blob, err := s.b.get(blobKey(rec.Paste.Id))
+	if err != nil {
+		Loggers.Error.Printf("Paste blob read error %s: %s", rec.Paste.Id, err)
+		return err
+	}
+	blob, err = s.unpackBlob(rec, blob)
+	if err != nil {
+		return err
+	}
+	rec.Paste.Data, err = rec.decodeBlob(blob)
+	return err
+}
+
+// Load a paste without its data.
+// Returns the size of the paste data as well.
+func (s *recordStore) GetMeta(id string) (Paste, int64, error) {
+	Loggers.Info.Printf("Load paste metadata %s", id)
+
+	rec, err := s.findRecord(id, false)
+	if err != nil {
+		return Paste{}, 0, err
+	}
+	rec.Paste.Data = ""
+	return *rec.Paste, rec.Size, nil
+}
+
+// Delete a paste, its discussion, its revisions and its attachments.
+// Pastes under legal hold are kept.
+func (s *recordStore) DeletePaste(id string) error {
+	l := s.locks.get(id)
+	l.Lock()
+	defer l.Unlock()
+	return s.deletePaste(id)
+}
+
+// Delete a paste unless it is under legal hold, caller must hold its lock.
+func (s *recordStore) deletePaste(id string) error {
+	unlock, err := s.lockHolds(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if rec, err := s.getRecord(id); err == nil && rec.Paste.Hold != nil {
+		return ErrHeld
+	}
+	return s.removePaste(id)
+}
+
+// Delete a paste, even under legal hold, caller must hold its lock.
+func (s *recordStore) removePaste(id string) error {
+	Loggers.Info.Printf("Delete paste %s", id)
+
+	if err := s.b.remove(id); err != nil {
+		return err
+	}
+
+	// Delete paste data, unless stored in a legacy record
+	if err := s.b.remove(blobKey(id)); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	// Delete paste discussion if any
+	if err := s.b.remove(discussionKey(id)); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	// Delete paste revisions if any
+	if err := s.b.remove(revisionsKey(id)); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	// Delete paste attachments if any
+	if err := s.b.remove(attachmentsKey(id)); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// Move a paste to the trash.
+// The paste keeps its records, hidden until it is restored or purged.
+func (s *recordStore) TrashPaste(id string) (Paste, error) {
+	Loggers.Info.Printf("Move paste %s to the trash", id)
+	return s.setTrashed(id, false, time.Now())
+}
+
+// Move a paste out of the trash.
+func (s *recordStore) RestorePaste(id string) (Paste, error) {
+	Loggers.Info.Printf("Restore paste %s from the trash", id)
+	return s.setTrashed(id, true, time.Time{})
+}
+
+// Set the trash date of a paste in the trash if trashed is set, out of the
+// trash otherwise.
+func (s *recordStore) setTrashed(id string, trashed bool, date time.Time) (Paste, error) {
+	l := s.locks.get(id)
+	l.Lock()
+	defer l.Unlock()
+
+	paste, err := s.loadPaste(id, trashed)
+	if err != nil {
+		return Paste{}, err
+	}
+	if !date.IsZero() && paste.Hold != nil {
+		return Paste{}, ErrHeld
+	}
+	paste.Trashed = date
+	if err := s.putMeta(&paste); err != nil {
+		return Paste{}, err
+	}
+	return paste, nil
+}
+
+// Delete a paste in the trash.
+// Pastes restored meanwhile are kept.
+func (s *recordStore) PurgePaste(id string) error {
+	l := s.locks.get(id)
+	l.Lock()
+	defer l.Unlock()
+
+	if _, err := s.findRecord(id, true); err != nil {
+		return err
+	}
+	return s.deletePaste(id)
+}
+
+// Place or release (nil hold) the legal hold of a paste.
+// Returns the previous hold of the paste, if any.
+// A paste whose views were used up under the hold is deleted on release.
+func (s *recordStore) SetHold(id string, hold *Hold) (*Hold, error) {
+	l := s.locks.get(id)
+	l.Lock()
+	defer l.Unlock()
+	unlock, err := s.lockHolds(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	rec, err := s.getRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	previous := rec.Paste.Hold
+	if hold == nil && rec.Paste.viewLimit() > 0 && rec.Paste.remainingViews() == 0 {
+		// Views were used up under the hold
+		return previous, s.removePaste(id)
+	}
+	rec.Paste.Hold = hold
+	return previous, s.writeMeta(rec, rec.Paste)
+}
+
+// Load a paste and count a view.
+// The first view date of pastes expiring after their first view is saved.
+// Pastes with a view limit are loaded along with the data of their
+// attachments, and views are counted.
+// Views of a paste are serialized: a paste with a view limit is deleted on its
+// last view, later views get ErrNotFound. Pastes under legal hold are kept
+// until released, later views still getting ErrNotFound.
+// Views are only serialized within a process: servers sharing an s3 bucket
+// may exceed the view limit.
+func (s *recordStore) ViewPaste(id string) (Paste, error) {
+	l := s.locks.get(id)
+	l.Lock()
+	defer l.Unlock()
+
+	paste, err := s.GetPaste(id)
+	if err != nil {
+		return Paste{}, err
+	}
+	if !paste.countsViews() {
+		return paste, nil
+	}
+	if paste.FirstView.IsZero() {
+		paste.FirstView = time.Now()
+	}
+	if paste.viewLimit() == 0 {
+		return paste, s.putMeta(&paste)
+	}
+	if paste.remainingViews() == 0 {
+		// Views used up, only kept under legal hold
+		return Paste{}, ErrNotFound
+	}
+
+	for i, a := range paste.Attachments {
+		loaded, err := s.GetAttachment(&paste, a.Id)
+		if err != nil {
+			return Paste{}, err
+		}
+		paste.Attachments[i] = loaded
+	}
+	// Comments are not saved with the paste, load them once it is written
+	var comments []Comment
+	if paste.Discussion {
+		if comments, err = s.ListComments(&paste); err != nil {
+			return Paste{}, err
+		}
+	}
+	paste.Views++
+	if paste.remainingViews() > 0 {
+		if err := s.putMeta(&paste); err != nil {
+			return Paste{}, err
+		}
+		paste.Comments = comments
+		return paste, nil
+	}
+
+	// Last view. Pastes under legal hold are kept
+	if paste.Hold != nil {
+		if err := s.putMeta(&paste); err != nil {
+			return Paste{}, err
+		}
+		paste.Comments = comments
+		return paste, nil
+	}
+	// The paste may have been deleted meanwhile, without view
+	err = s.deletePaste(id)
+	if err == ErrHeld {
+		// Held meanwhile by the hold command
+		err = s.putMeta(&paste)
+	}
+	if err != nil {
+		return Paste{}, err
+	}
+	paste.Comments = comments
+	return paste, nil
+}
+
+// Save a comment.
+func (s *recordStore) AppendComment(paste *Paste, comment *Comment) error {
+	Loggers.Info.Printf("Save comment %s", comment.Id)
+
+	// Marshal comment
+	key := commentKey(paste.Id, comment.Id)
+	data, err := s.encode(key, comment)
+	if err != nil {
+		return err
+	}
+
+	return s.b.create(key, data)
+}
+
+// Load a comment.
+func (s *recordStore) GetComment(paste *Paste, id string) (Comment, error) {
+	Loggers.Info.Printf("Load comment %s", id)
+
+	// Read record
+	key := commentKey(paste.Id, id)
+	data, err := s.b.get(key)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	// Unmarshal data
+	comment := Comment{Id: id}
+	if err := s.decode(key, data, &comment); err != nil {
+		return Comment{}, err
+	}
+
+	return comment, nil
+}
+
+// Load the comments of a paste, sorted by date.
+func (s *recordStore) ListComments(paste *Paste) ([]Comment, error) {
+	Loggers.Info.Printf("Load comments of paste %s", paste.Id)
+
+	ids, err := s.b.list(discussionKey(paste.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	comments := make([]Comment, len(ids))
+	for i, id := range ids {
+		c, err := s.GetComment(paste, id)
+		if err != nil {
+			return nil, err
+		}
+		comments[i] = c
+	}
+
+	sort.Sort(CommentsByDate(comments))
+
+	return comments, nil
+}
+
+// Save a previous revision of a paste.
+func (s *recordStore) AddRevision(paste *Paste, rev *Revision) error {
+	Loggers.Info.Printf("Save revision %d of paste %s", rev.Revision, paste.Id)
+
+	// Marshal revision
+	key := revisionKey(paste.Id, rev.Revision)
+	data, err := s.encode(key, rev)
+	if err != nil {
+		return err
+	}
+
+	// Revisions of deleted pastes would be left behind
+	l := s.locks.get(paste.Id)
+	l.Lock()
+	defer l.Unlock()
+	if _, err := s.b.get(paste.Id); err != nil {
+		return err
+	}
+	return s.b.create(key, data)
+}
+
+// Load a previous revision of a paste.
+func (s *recordStore) GetRevision(paste *Paste, n int) (Revision, error) {
+	Loggers.Info.Printf("Load revision %d of paste %s", n, paste.Id)
+
+	// Read record
+	key := revisionKey(paste.Id, n)
+	data, err := s.b.get(key)
+	if err != nil {
+		return Revision{}, err
+	}
+
+	// Unmarshal data
+	rev := Revision{Revision: n}
+	if err := s.decode(key, data, &rev); err != nil {
+		return Revision{}, err
+	}
+
+	return rev, nil
+}
+
+// Load the previous revisions of a paste, sorted by number.
+func (s *recordStore) ListRevisions(paste *Paste) ([]Revision, error) {
+	Loggers.Info.Printf("Load revisions of paste %s", paste.Id)
+
+	names, err := s.b.list(revisionsKey(paste.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]Revision, 0, len(names))
+	for _, name := range names {
+		n, err := strconv.Atoi(name)
+		if err != nil {
+			// Not a revision
+			continue
+		}
+		rev, err := s.GetRevision(paste, n)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+
+	sort.Sort(RevisionsByNumber(revisions))
+
+	return revisions, nil
+}
+
+// Save the data of an attachment.
+func (s *recordStore) PutAttachment(paste *Paste, attachment *Attachment) error {
+	Loggers.Info.Printf("Save attachment %s of paste %s", attachment.Id, paste.Id)
+
+	data, err := encodeAttachment(attachment.Data)
+	if err != nil {
+		return err
+	}
+	key := attachmentKey(paste.Id, attachment.Id)
+	data, err = s.pack(key, data)
+	if err != nil {
+		return err
+	}
+
+	return s.b.create(key, data)
+}
+
+// Load an attachment of a paste, along with its data.
+func (s *recordStore) GetAttachment(paste *Paste, id string) (Attachment, error) {
+	Loggers.Info.Printf("Load attachment %s of paste %s", id, paste.Id)
+
+	attachment, ok := paste.attachment(id)
+	if !ok {
+		return Attachment{}, ErrNotFound
+	}
+
+	// Read record
+	key := attachmentKey(paste.Id, id)
+	data, err := s.b.get(key)
+	if err != nil {
+		return Attachment{}, err
+	}
+	data, err = s.unpack(key, data)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	attachment.Data, err = decodeAttachment(data)
+	if err != nil {
+		return Attachment{}, err
+	}
+	return attachment, nil
+}
+
+// Call fn for every stored paste.
+// Unreadable pastes are quarantined instead of aborting the walk, but pastes
+// which cannot be read with the current configuration abort it.
+func (s *recordStore) Walk(fn func(paste *Paste) error) error {
+	return s.walkRecords(true, func(rec *pasteRecord) error {
+		return fn(rec.Paste)
+	})
+}
+
+// Call fn for every stored paste, without loading paste data.
+// Unreadable pastes are quarantined instead of aborting the walk, but pastes
+// which cannot be read with the current configuration abort it.
+func (s *recordStore) WalkMeta(fn func(paste *Paste, size int64) error) error {
+	return s.walkRecords(false, func(rec *pasteRecord) error {
+		rec.Paste.Data = ""
+		return fn(rec.Paste, rec.Size)
+	})
+}
+
+// Call fn with the record of every stored paste, its data loaded if full is set.
+func (s *recordStore) walkRecords(full bool, fn func(rec *pasteRecord) error) error {
+	return s.b.walk(func(key string) error {
+		if !regexName.MatchString(key) {
+			// Not a paste
+			return nil
+		}
+		rec, err := s.getRecord(key)
+		if err == nil && full {
+			err = s.loadBlob(&rec)
+		}
+		if err == ErrNotFound {
+			// Deleted in the meantime
+			return nil
+		}
+		if isConfigError(err) {
+			// Not corrupt: fix the configuration
+			return fmt.Errorf("cannot read paste %s: %s", key, err)
+		}
+		if err != nil {
+			Loggers.Error.Printf("Paste %s is unreadable, quarantine: %s", key, err)
+			if qerr := s.b.quarantine(key); qerr != nil {
+				return fmt.Errorf("cannot quarantine paste %s: %s", key, qerr)
+			}
+			if qerr := s.b.quarantine(blobKey(key)); qerr != nil && qerr != ErrNotFound {
+				return fmt.Errorf("cannot quarantine paste %s: %s", key, qerr)
+			}
+			return nil
+		}
+		return fn(&rec)
+	})
+}
@@ -0,0 +1,299 @@
+package bingo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Run the store test suite against a store.
+func testStore(t *testing.T, s Store) {
+
+	paste := newPaste("Awesome paste")
+	paste.Discussion = true
+	paste.Expire = paste.Postdate.Add(time.Hour)
+
+	if err := s.CreatePaste(&paste); err != nil {
+		t.Fatalf("CreatePaste() error: %s", err)
+	}
+	if err := s.CreatePaste(&paste); err != ErrExists {
+		t.Errorf("CreatePaste() twice error == %v, want %v", err, ErrExists)
+	}
+
+	loaded, err := s.GetPaste(paste.Id)
+	if err != nil {
+		t.Fatalf("GetPaste(%q) error: %s", paste.Id, err)
+	}
+	if loaded.Data != paste.Data || !loaded.Expire.Equal(paste.Expire) || !loaded.Discussion {
+		t.Errorf("GetPaste(%q) == %+v, want %+v", paste.Id, loaded, paste)
+	}
+
+	// Comments
+	first := newComment("First comment", nil)
+	second := newComment("Second comment", &first)
+	second.Postdate = first.Postdate.Add(time.Second)
+	for _, c := range []*Comment{&second, &first} {
+		if err := s.AppendComment(&paste, c); err != nil {
+			t.Fatalf("AppendComment(%q) error: %s", c.Id, err)
+		}
+	}
+	if err := s.AppendComment(&paste, &first); err != ErrExists {
+		t.Errorf("AppendComment(%q) twice error == %v, want %v", first.Id, err, ErrExists)
+	}
+
+	c, err := s.GetComment(&paste, second.Id)
+	if err != nil {
+		t.Fatalf("GetComment(%q) error: %s", second.Id, err)
+	}
+	if c.Data != second.Data || c.Parent != first.Id {
+		t.Errorf("GetComment(%q) == %+v, want %+v", second.Id, c, second)
+	}
+
+	comments, err := s.ListComments(&paste)
+	if err != nil {
+		t.Fatalf("ListComments() error: %s", err)
+	}
+	if len(comments) != 2 || comments[0].Id != first.Id || comments[1].Id != second.Id {
+		t.Errorf("ListComments() == %+v, want [%s %s]", comments, first.Id, second.Id)
+	}
+
+	// Revisions
+	for n, data := range []string{"First revision", "Second revision"} {
+		rev := Revision{Revision: n, Data: data, Postdate: paste.Postdate.Add(time.Duration(n) * time.Second)}
+		if err := s.AddRevision(&paste, &rev); err != nil {
+			t.Fatalf("AddRevision(%d) error: %s", n, err)
+		}
+	}
+	if err := s.AddRevision(&paste, &Revision{Revision: 1}); err != ErrExists {
+		t.Errorf("AddRevision(1) twice error == %v, want %v", err, ErrExists)
+	}
+	if err := s.AddRevision(&Paste{Id: "missing"}, &Revision{}); err != ErrNotFound {
+		t.Errorf("AddRevision() of a missing paste error == %v, want %v", err, ErrNotFound)
+	}
+	rev, err := s.GetRevision(&paste, 1)
+	if err != nil {
+		t.Fatalf("GetRevision(1) error: %s", err)
+	}
+	if rev.Revision != 1 || rev.Data != "Second revision" {
+		t.Errorf("GetRevision(1) == %+v, want revision 1", rev)
+	}
+	revisions, err := s.ListRevisions(&paste)
+	if err != nil {
+		t.Fatalf("ListRevisions() error: %s", err)
+	}
+	if len(revisions) != 2 || revisions[0].Revision != 0 || revisions[1].Revision != 1 {
+		t.Errorf("ListRevisions() == %+v, want revisions 0 and 1", revisions)
+	}
+
+	// Walk
+	other := newPaste("1337")
+	if err := s.PutPaste(&other); err != ErrNotFound {
+		t.Errorf("PutPaste() of a missing paste error == %v, want %v", err, ErrNotFound)
+	}
+	if err := s.CreatePaste(&other); err != nil {
+		t.Fatalf("CreatePaste() error: %s", err)
+	}
+	seen := make(map[string]bool)
+	if err := s.Walk(func(p *Paste) error {
+		seen[p.Id] = true
+		return nil
+	}); err != nil {
+		t.Fatalf("Walk() error: %s", err)
+	}
+	if len(seen) != 2 || !seen[paste.Id] || !seen[other.Id] {
+		t.Errorf("Walk() visited %v, want %s and %s", seen, paste.Id, other.Id)
+	}
+
+	// Delete
+	if err := s.DeletePaste(paste.Id); err != nil {
+		t.Fatalf("DeletePaste(%q) error: %s", paste.Id, err)
+	}
+	if _, err := s.GetPaste(paste.Id); err != ErrNotFound {
+		t.Errorf("GetPaste(%q) after delete error == %v, want %v", paste.Id, err, ErrNotFound)
+	}
+	if _, err := s.GetComment(&paste, first.Id); err != ErrNotFound {
+		t.Errorf("GetComment(%q) after delete error == %v, want %v", first.Id, err, ErrNotFound)
+	}
+	if _, err := s.GetRevision(&paste, 0); err != ErrNotFound {
+		t.Errorf("GetRevision(0) after delete error == %v, want %v", err, ErrNotFound)
+	}
+	if err := s.DeletePaste(paste.Id); err != ErrNotFound {
+		t.Errorf("DeletePaste(%q) twice error == %v, want %v", paste.Id, err, ErrNotFound)
+	}
+}
+
+// Create a temporary data folder.
+func tempRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "bingo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, newMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+
+	testStore(t, newFileStore(root, 2))
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+
+	s := newFileStore(root, 2)
+	b := s.b.(*fileBackend)
+
+	good := newPaste("Awesome paste")
+	if err := s.CreatePaste(&good); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncated paste, as left by a crash in the middle of a write
+	bad := newPaste("1337")
+	if err := os.MkdirAll(filepath.Dir(b.path(bad.Id)), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(b.path(bad.Id), []byte(`{"data":"13`), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stale temporary file
+	tmp := filepath.Join(filepath.Dir(b.path(good.Id)), tempPrefix+"1234")
+	if err := ioutil.WriteFile(tmp, []byte(`{}`), 0640); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleTempAge)
+	os.Chtimes(tmp, old, old)
+
+	seen := make([]string, 0)
+	if err := s.Walk(func(p *Paste) error {
+		seen = append(seen, p.Id)
+		return nil
+	}); err != nil {
+		t.Fatalf("Walk() error: %s", err)
+	}
+	if len(seen) != 1 || seen[0] != good.Id {
+		t.Errorf("Walk() visited %v, want [%s]", seen, good.Id)
+	}
+
+	if _, err := os.Stat(b.path(bad.Id)); !os.IsNotExist(err) {
+		t.Errorf("unreadable paste %s was not quarantined", bad.Id)
+	}
+	if lost, _ := filepath.Glob(filepath.Join(root, lostFound, bad.Id+".*")); len(lost) != 1 {
+		t.Errorf("lost+found holds %v, want the unreadable paste %s", lost, bad.Id)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("stale temporary file %s was not removed", tmp)
+	}
+}
+
+// View pastes with a view limit concurrently, views must not exceed the limit.
+func testViewPaste(t *testing.T, s Store) {
+	const readers = 50
+
+	for round := 0; round < 10; round++ {
+		paste := newPaste("Limited paste")
+		if round%2 == 0 {
+			// Burn pastes are read once
+			paste.Burn = true
+		} else {
+			paste.MaxViews = 3
+		}
+		paste.Attachments = []Attachment{newAttachment("name", "iVBORw0KGgo=")}
+		if err := s.CreatePaste(&paste); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutAttachment(&paste, &paste.Attachments[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		results := make(chan error, readers)
+		start := make(chan struct{})
+		for i := 0; i < readers; i++ {
+			go func() {
+				<-start
+				viewed, err := s.ViewPaste(paste.Id)
+				if err == nil && (viewed.Data != paste.Data || viewed.Attachments[0].Data != paste.Attachments[0].Data) {
+					t.Errorf("ViewPaste(%q) == %+v, want %+v", paste.Id, viewed, paste)
+				}
+				results <- err
+			}()
+		}
+		close(start)
+
+		views := 0
+		for i := 0; i < readers; i++ {
+			if err := <-results; err == nil {
+				views++
+			} else if err != ErrNotFound {
+				t.Errorf("ViewPaste(%q) error: %s", paste.Id, err)
+			}
+		}
+		if views != paste.viewLimit() {
+			t.Errorf("paste %s viewed %d times, want %d", paste.Id, views, paste.viewLimit())
+		}
+		if _, err := s.GetPaste(paste.Id); err != ErrNotFound {
+			t.Errorf("GetPaste(%q) after last view error == %v, want %v", paste.Id, err, ErrNotFound)
+		}
+	}
+
+	// Saving a paste keeps its view count
+	paste := newPaste("Limited paste")
+	paste.MaxViews = 3
+	if err := s.CreatePaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ViewPaste(paste.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutPaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+	if viewed, err := s.ViewPaste(paste.Id); err != nil || viewed.Views != 2 || viewed.remainingViews() != 1 {
+		t.Errorf("ViewPaste(%q) after PutPaste() == %+v, %v, want 2 views", paste.Id, viewed, err)
+	}
+	s.DeletePaste(paste.Id)
+}
+
+func TestViewPaste(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+
+	testViewPaste(t, newMemoryStore())
+	testViewPaste(t, newFileStore(root, 2))
+
+	// Views and trash dates only write the metadata record, sealed blobs
+	// would differ if written again
+	s := newMemoryStore()
+	s.sealer, _ = newSealer(testKey1, nil)
+	paste := newPaste("Limited paste")
+	paste.MaxViews = 3
+	if err := s.CreatePaste(&paste); err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := s.b.get(blobKey(paste.Id))
+	if _, err := s.ViewPaste(paste.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TrashPaste(paste.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetHold(paste.Id, &Hold{Date: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := s.b.get(blobKey(paste.Id)); !bytes.Equal(data, blob) {
+		t.Errorf("paste blob written again by metadata changes")
+	}
+	if trashed, err := s.GetTrash(paste.Id); err != nil || trashed.Data != paste.Data || trashed.Views != 1 || trashed.Hold == nil {
+		t.Errorf("GetTrash(%q) == %+v, %v, want the paste viewed once and held", paste.Id, trashed, err)
+	}
+}